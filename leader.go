@@ -0,0 +1,135 @@
+package autopilot
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+// leaderState tracks the leader preference between rounds
+type leaderState struct {
+	// leader is the last leader seen and notPreferredSince the time since it's not preferred
+	leader            raft.ServerID
+	notPreferredSince time.Time
+	// proposed is the preferred server proposed this round to receive the leadership
+	proposed raft.ServerID
+	// lastPreferredTransfer is the time of the last transfer to a preferred server
+	lastPreferredTransfer time.Time
+}
+
+// leaderTransferTarget returns the voter, of the given ones, to transfer the leadership to. Voters that
+// declared themselves as no leader are skipped and the rest are sorted with the leader ranker.
+func (p *ImprovedPromoter) leaderTransferTarget(extraConfig ExtraConfig, state *ra.State, voters []raft.ServerID) (raft.ServerID, bool) {
+	eligible := make([]raft.ServerID, 0, len(voters))
+	for _, id := range voters {
+		srv, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		if p.serverInfo(extraConfig, srv.Server).NoLeader {
+			p.logger.Debug("Skipping no leader server for the leadership", "id", id)
+			continue
+		}
+		eligible = append(eligible, id)
+	}
+	if len(eligible) == 0 {
+		p.logger.Debug("No voter ready to receive the leadership", "voters", voters)
+		return "", false
+	}
+	rankServers(eligible, state, p.leaderRanker)
+	return eligible[0], true
+}
+
+// hasLeaderPreference returns true if any preferred leader is configured
+func hasLeaderPreference(extraConfig ExtraConfig) bool {
+	return extraConfig.PreferredLeaderTag != "" || len(extraConfig.PreferredLeaderZones) > 0 || len(extraConfig.PreferredLeaderServers) > 0
+}
+
+// isPreferredLeader returns true if the server is preferred as leader by its ID, zone or meta tag
+func (p *ImprovedPromoter) isPreferredLeader(extraConfig ExtraConfig, srv ra.Server) bool {
+	info := p.serverInfo(extraConfig, srv)
+	if info.NoLeader {
+		return false
+	}
+	for _, id := range extraConfig.PreferredLeaderServers {
+		if id == srv.ID {
+			return true
+		}
+	}
+	for _, zone := range extraConfig.PreferredLeaderZones {
+		if zone == info.Zone {
+			return true
+		}
+	}
+	if tag := extraConfig.PreferredLeaderTag; tag != "" {
+		preferred, _ := parseBoolTag(srv.Meta[tag])
+		return preferred
+	}
+	return false
+}
+
+// preferredLeader returns the voter to transfer the leadership to if the current leader isn't preferred,
+// or an empty ID. The leader must have been not preferred for ExtraConfig.LeaderPreferenceDelay and the
+// last transfer must be older than ExtraConfig.LeaderTransferCooldown, so the leadership doesn't bounce.
+// Only healthy voters (caught up with the leader as checked by autopilot) that are stable can receive it.
+func (p *ImprovedPromoter) preferredLeader(config *ra.Config, extraConfig ExtraConfig, state *ra.State) raft.ServerID {
+	if !hasLeaderPreference(extraConfig) {
+		return ""
+	}
+	leader, ok := state.Servers[state.Leader]
+	if !ok {
+		return ""
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	if p.isPreferredLeader(extraConfig, leader.Server) {
+		p.leader.leader, p.leader.notPreferredSince = state.Leader, time.Time{}
+		return ""
+	}
+	if p.leader.leader != state.Leader || p.leader.notPreferredSince.IsZero() {
+		p.leader.leader, p.leader.notPreferredSince = state.Leader, now
+	}
+	if since := now.Sub(p.leader.notPreferredSince); since < extraConfig.LeaderPreferenceDelay {
+		p.logger.Debug("Leader not preferred, waiting before transferring the leadership", "leader", state.Leader, "since", since)
+		return ""
+	}
+	if last := p.leader.lastPreferredTransfer; !last.IsZero() && now.Sub(last) < extraConfig.LeaderTransferCooldown {
+		p.logger.Debug("Leader not preferred, leadership transferred recently", "leader", state.Leader, "last", last)
+		return ""
+	}
+
+	minStableDuration := state.ServerStabilizationTime(config)
+	candidates := make([]raft.ServerID, 0)
+	for _, id := range state.Voters {
+		srv, ok := state.Servers[id]
+		if !ok || id == state.Leader {
+			continue
+		}
+		if srv.Health.Healthy && srv.Health.IsStable(now, minStableDuration) && p.isPreferredLeader(extraConfig, srv.Server) {
+			candidates = append(candidates, id)
+		}
+	}
+	target, ok := p.leaderTransferTarget(extraConfig, state, candidates)
+	if !ok {
+		return ""
+	}
+	p.leader.proposed = target
+	return target
+}
+
+// recordPreferredTransfer starts the cooldown if the leadership transfer to a preferred server proposed
+// this round is in the changes returned, after the rate limits are applied
+func (p *ImprovedPromoter) recordPreferredTransfer(state *ra.State, changes ra.RaftChanges) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if proposed := p.leader.proposed; proposed != "" && proposed == changes.Leader {
+		p.leader.lastPreferredTransfer = p.now()
+		p.logger.Info("Transferring the leadership to a preferred server", "leader", state.Leader, "target", proposed)
+	}
+	p.leader.proposed = ""
+}
@@ -0,0 +1,178 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+func TestPreferredLeader(t *testing.T) {
+	m := func(zone, preferred string) map[string]string {
+		return map[string]string{"zone": zone, "preferred": preferred}
+	}
+	servers := []*ra.ServerState{
+		testServer("a", ra.RaftLeader, m("1", "")),
+		testServer("b", ra.RaftVoter, m("2", "")),
+		testServer("c", ra.RaftVoter, m("3", "true")),
+	}
+
+	cases := []struct {
+		name    string
+		extra   ExtraConfig
+		servers []*ra.ServerState
+		leader  raft.ServerID
+	}{
+		{
+			name:    "no preference",
+			servers: servers,
+		},
+		{
+			name:    "preferred server",
+			extra:   ExtraConfig{PreferredLeaderServers: []raft.ServerID{"b"}},
+			servers: servers,
+			leader:  "b",
+		},
+		{
+			name:    "preferred zone",
+			extra:   ExtraConfig{RedundancyZoneTag: "zone", PreferredLeaderZones: []string{"3"}},
+			servers: servers,
+			leader:  "c",
+		},
+		{
+			name:    "preferred tag",
+			extra:   ExtraConfig{PreferredLeaderTag: "preferred"},
+			servers: servers,
+			leader:  "c",
+		},
+		{
+			name:    "leader already preferred",
+			extra:   ExtraConfig{PreferredLeaderServers: []raft.ServerID{"a", "b"}},
+			servers: servers,
+		},
+		{
+			name:  "unhealthy preferred server",
+			extra: ExtraConfig{PreferredLeaderTag: "preferred"},
+			servers: []*ra.ServerState{
+				servers[0],
+				servers[1],
+				failedServer("c", ra.RaftVoter, m("3", "true")),
+			},
+		},
+		{
+			name:  "no leader preferred server",
+			extra: ExtraConfig{PreferredLeaderTag: "preferred", NoLeaderTag: "preferred"},
+			servers: []*ra.ServerState{
+				servers[0],
+				servers[1],
+				servers[2],
+			},
+		},
+		{
+			name:  "pending promotions",
+			extra: ExtraConfig{PreferredLeaderTag: "preferred"},
+			servers: []*ra.ServerState{
+				servers[0],
+				servers[1],
+				servers[2],
+				testServer("d", ra.RaftNonVoter, m("4", "")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter()
+		changes := p.CalculatePromotionsAndDemotions(testConfig(tc.extra), testState(tc.servers...))
+		if changes.Leader != tc.leader {
+			t.Errorf("%s: expected leader %q, got %q", tc.name, tc.leader, changes.Leader)
+		}
+	}
+}
+
+func TestPreferredLeaderHysteresis(t *testing.T) {
+	config := testConfig(ExtraConfig{
+		PreferredLeaderServers: []raft.ServerID{"c"},
+		LeaderPreferenceDelay:  time.Minute,
+		LeaderTransferCooldown: 10 * time.Minute,
+	})
+	start := time.Now()
+	now := start
+	p := testPromoter()
+	p.now = func() time.Time { return now }
+
+	leaderIn := func(leader string) *ra.State {
+		var servers []*ra.ServerState
+		for _, id := range []string{"a", "b", "c"} {
+			state := ra.RaftVoter
+			if id == leader {
+				state = ra.RaftLeader
+			}
+			servers = append(servers, testServer(id, state, nil))
+		}
+		return testState(servers...)
+	}
+
+	rounds := []struct {
+		after  time.Duration
+		leader string
+		target raft.ServerID
+	}{
+		{after: 0, leader: "a"},
+		{after: 30 * time.Second, leader: "a"},
+		{after: time.Minute, leader: "a", target: "c"},
+		// the preferred leader is lost, wait the cooldown
+		{after: 2 * time.Minute, leader: "c"},
+		{after: 3 * time.Minute, leader: "b"},
+		{after: 5 * time.Minute, leader: "b"},
+		{after: 11 * time.Minute, leader: "b", target: "c"},
+	}
+	for _, round := range rounds {
+		now = start.Add(round.after)
+		changes := p.CalculatePromotionsAndDemotions(config, leaderIn(round.leader))
+		if changes.Leader != round.target {
+			t.Errorf("after %s with leader %s: expected target %q, got %q", round.after, round.leader, round.target, changes.Leader)
+		}
+	}
+}
+
+func TestPreferredLeaderRateLimited(t *testing.T) {
+	config := testConfig(ExtraConfig{
+		PreferredLeaderServers: []raft.ServerID{"c"},
+		LeaderTransferCooldown: time.Hour,
+		ChangeInterval:         time.Minute,
+	})
+	start := time.Now()
+	now := start
+	p := testPromoter()
+	p.now = func() time.Time { return now }
+
+	rounds := []struct {
+		after   time.Duration
+		servers []*ra.ServerState
+		target  raft.ServerID
+	}{
+		{after: 0, servers: []*ra.ServerState{
+			testServer("a", ra.RaftLeader, nil),
+			testServer("b", ra.RaftVoter, nil),
+			testServer("c", ra.RaftNonVoter, nil),
+		}},
+		// the transfer is held back by the rate limits, so the cooldown doesn't start
+		{after: 10 * time.Second, servers: []*ra.ServerState{
+			testServer("a", ra.RaftLeader, nil),
+			testServer("b", ra.RaftVoter, nil),
+			testServer("c", ra.RaftVoter, nil),
+		}},
+		{after: time.Minute, servers: []*ra.ServerState{
+			testServer("a", ra.RaftLeader, nil),
+			testServer("b", ra.RaftVoter, nil),
+			testServer("c", ra.RaftVoter, nil),
+		}, target: "c"},
+	}
+	for i, r := range rounds {
+		now = start.Add(r.after)
+		changes := p.CalculatePromotionsAndDemotions(config, testState(r.servers...))
+		if changes.Leader != r.target {
+			t.Errorf("round %d: expected target %q, got %q", i, r.target, changes.Leader)
+		}
+	}
+}
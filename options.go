@@ -15,3 +15,32 @@ func WithLogger(logger hclog.Logger) Option {
 		p.logger = logger.Named("promoter")
 	}
 }
+
+// WithNonVoterTag returns an Option to set the meta key used by servers to declare
+// themselves as non voters (e.g. nonvoter=true). ExtraConfig.NonVoterTag takes
+// precedence over this value.
+func WithNonVoterTag(tag string) Option {
+	return func(p *ImprovedPromoter) {
+		p.nonVoterTag = tag
+	}
+}
+
+// WithRanker returns an Option to set the Ranker used to select which servers are promoted
+// when there are several candidates. By default StableHealthRanker is used.
+func WithRanker(ranker Ranker) Option {
+	return func(p *ImprovedPromoter) {
+		if ranker != nil {
+			p.ranker = ranker
+		}
+	}
+}
+
+// WithLeaderRanker returns an Option to set the Ranker used to select the voter that receives the
+// leadership when it's transferred. By default StableHealthRanker is used.
+func WithLeaderRanker(ranker Ranker) Option {
+	return func(p *ImprovedPromoter) {
+		if ranker != nil {
+			p.leaderRanker = ranker
+		}
+	}
+}
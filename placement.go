@@ -0,0 +1,67 @@
+package autopilot
+
+import (
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// placement tracks the voters in each failure domain so new voters are spread across
+// them, maximising the diversity at the top level first
+type placement struct {
+	levels int
+	voters map[string]int
+}
+
+func newPlacement(levels int) *placement {
+	return &placement{levels: levels, voters: make(map[string]int)}
+}
+
+// add counts a voter in the given failure domains
+func (pl *placement) add(domains []string) {
+	for level := 0; level < pl.levels; level++ {
+		pl.voters[domainPath(domains, level)]++
+	}
+}
+
+// less returns true if a voter in the failure domains a adds more diversity than one in b
+func (pl *placement) less(a, b []string) bool {
+	return pl.compare(a, b) < 0
+}
+
+// compare returns -1 if a voter in the failure domains a adds more diversity than one in b,
+// 1 if it adds less and 0 if both add the same
+func (pl *placement) compare(a, b []string) int {
+	for level := 0; level < pl.levels; level++ {
+		va, vb := pl.voters[domainPath(a, level)], pl.voters[domainPath(b, level)]
+		switch {
+		case va < vb:
+			return -1
+		case va > vb:
+			return 1
+		}
+	}
+	return 0
+}
+
+// domainPath returns the path identifying the failure domain at the given level
+func domainPath(domains []string, level int) string {
+	path := make([]string, level+1)
+	copy(path, domains)
+	return strings.Join(path, "/")
+}
+
+// selectCandidate returns the index of the best eligible candidate according to less.
+// On ties the first candidate is selected, so the ranking order is kept.
+func selectCandidate(candidates []raft.ServerID, eligible func(raft.ServerID) bool, less func(a, b raft.ServerID) bool) (int, bool) {
+	best := -1
+	for i, id := range candidates {
+		if !eligible(id) {
+			continue
+		}
+		if best == -1 || less(id, candidates[best]) {
+			best = i
+		}
+	}
+	return best, best != -1
+}
@@ -1,6 +1,8 @@
 package autopilot
 
 import (
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
@@ -13,13 +15,30 @@ const baseVersion = "v0.0.1"
 
 // ImprovedPromoter is a new version of the promoter with improved funcionality
 type ImprovedPromoter struct {
-	logger hclog.Logger
+	logger       hclog.Logger
+	nonVoterTag  string
+	ranker       Ranker
+	leaderRanker Ranker
+	now          func() time.Time
+
+	lock    sync.Mutex
+	upgrade UpgradeState  // last computed upgrade state, to report phase changes
+	leader  leaderState   // leader preference tracking, for hysteresis and cooldown
+	history changeHistory // changes made, for rate limiting
+
+	warnLock      sync.Mutex
+	warned        map[string]bool // server warnings logged in the current round
+	invalidTarget string          // invalid upgrade target version already warned about
 }
 
 // New will create a new promoter
 func New(options ...Option) ra.Promoter {
 	p := &ImprovedPromoter{
-		logger: hclog.Default().Named("promoter"),
+		logger:       hclog.Default().Named("promoter"),
+		ranker:       StableHealthRanker(),
+		leaderRanker: StableHealthRanker(),
+		now:          time.Now,
+		upgrade:      UpgradeState{Phase: UpgradeNone},
 	}
 	for _, opt := range options {
 		opt(p)
@@ -32,226 +51,991 @@ func New(options ...Option) ra.Promoter {
 // Promoter methods and the application utilizing autopilot. If the value returned is
 // nil the extended state will not be updated.
 func (p *ImprovedPromoter) GetServerExt(config *ra.Config, srvState *ra.ServerState) interface{} {
-	extraConfig := config.Ext.(ExtraConfig)
+	extraConfig := p.extraConfig(config)
 
 	ext := ExtraServerInfo{}
-	if srvState.Server.Ext != nil {
-		ext = srvState.Server.Ext.(ExtraServerInfo)
+	previous, err := toExtraServerInfo(srvState.Server.Ext)
+	if err != nil {
+		p.logger.Warn("Ignoring invalid server ext", "id", srvState.Server.ID, "error", err)
+	} else if previous != nil {
+		ext = *previous
 	}
-	ext.Zone = string(srvState.Server.ID)
+	ext = p.buildServerInfo(extraConfig, srvState.Server, ext)
+	p.logger.Debug("Server ext", "id", srvState.Server.ID, "version", ext.Version, "invalidversion", ext.InvalidVersion, "zone", ext.Zone, "nonvoter", ext.NonVoter)
+	return ext
+}
+
+// buildServerInfo fills the server info from the server metadata, starting from
+// the given ext
+func (p *ImprovedPromoter) buildServerInfo(extraConfig ExtraConfig, srv ra.Server, ext ExtraServerInfo) ExtraServerInfo {
+	ext.Zone = string(srv.ID)
+	ext.Untagged = false
 	if zoneTag := extraConfig.RedundancyZoneTag; zoneTag != "" {
-		if zone := srvState.Server.Meta[zoneTag]; zone != "" {
+		if zone := srv.Meta[zoneTag]; zone != "" {
 			ext.Zone = zone
+		} else {
+			ext.Untagged = true
+			policy := untaggedZonePolicy(extraConfig)
+			if policy == UntaggedDefaultZone {
+				ext.Zone = DefaultZone
+			}
+			p.logger.Debug("Server without zone", "id", srv.ID, "tag", zoneTag, "policy", policy, "zone", ext.Zone)
+		}
+	}
+	// invalid tag values are only warned when they change, not every time the ext is rebuilt
+	previous := ext
+	ext.InvalidNonVoter, ext.InvalidNoLeader = "", ""
+	if nvTag := p.nonVoterTagFor(extraConfig); nvTag != "" {
+		value := srv.Meta[nvTag]
+		nonVoter, ok := parseBoolTag(value)
+		if !ok {
+			if value != previous.InvalidNonVoter {
+				p.warnServer(srv.ID, "Invalid non voter tag value, server will be considered a voter", "tag", nvTag, "value", value)
+			}
+			ext.InvalidNonVoter = value
 		}
+		ext.NonVoter = nonVoter
+	}
+	ext.NoLeader = false
+	if nlTag := extraConfig.NoLeaderTag; nlTag != "" {
+		value := srv.Meta[nlTag]
+		noLeader, ok := parseBoolTag(value)
+		if !ok {
+			if value != previous.InvalidNoLeader {
+				p.warnServer(srv.ID, "Invalid no leader tag value, server will be able to become leader", "tag", nlTag, "value", value)
+			}
+			ext.InvalidNoLeader = value
+		}
+		ext.NoLeader = noLeader
+	}
+	ext.FailureDomains = nil
+	for _, tag := range extraConfig.FailureDomainTags {
+		ext.FailureDomains = append(ext.FailureDomains, srv.Meta[tag])
+	}
+	ext.Version = srv.Version
+	if ext.Version == "" {
+		ext.Version = baseVersion
 	}
-	ext.Version = srvState.Server.Version
 	if uTag := extraConfig.UpgradeVersionTag; uTag != "" {
-		version := srvState.Server.Meta[uTag]
+		version := srv.Meta[uTag]
 		if version == "" {
 			version = baseVersion
 		}
 		ext.Version = version
 	}
-	p.logger.Debug("Server ext", "id", srvState.Server.ID, "version", ext.Version, "zone", ext.Zone, "nonvoter", ext.NonVoter)
+	ext.ParsedVersion, ext.InvalidVersion = nil, false
+	if v, err := version.NewVersion(ext.Version); err != nil {
+		// only warn when the version changes, not every time the ext is rebuilt
+		if !previous.InvalidVersion || previous.Version != ext.Version {
+			p.warnServer(srv.ID, "Invalid server version, server will be left out of upgrade decisions", "version", ext.Version, "error", err)
+		}
+		ext.InvalidVersion = true
+	} else {
+		ext.ParsedVersion = v
+	}
 	return ext
 }
 
+// extraConfig returns the ExtraConfig stored in the autopilot config. A nil config or
+// Ext results in the default (zero value) ExtraConfig: no redundancy zones, upgrade
+// migration enabled using the server version and no non voter tag. An Ext of an
+// unexpected type is logged and the default is used as well.
+func (p *ImprovedPromoter) extraConfig(config *ra.Config) ExtraConfig {
+	if config == nil {
+		return ExtraConfig{}
+	}
+	extraConfig, err := toExtraConfig(config.Ext)
+	if err != nil {
+		p.logger.Warn("Invalid autopilot config ext, using defaults", "error", err)
+	}
+	return extraConfig
+}
+
+// startRound resolves the ExtraConfig for a call to one of the promoter methods and
+// resets the server warnings, so each of them is logged once per round.
+func (p *ImprovedPromoter) startRound(config *ra.Config) ExtraConfig {
+	p.warnLock.Lock()
+	p.warned = nil
+	p.warnLock.Unlock()
+	return p.extraConfig(config)
+}
+
+// warnServer logs a warning about a server unless it was already logged in the current round
+func (p *ImprovedPromoter) warnServer(id raft.ServerID, msg string, args ...interface{}) {
+	p.warnLock.Lock()
+	defer p.warnLock.Unlock()
+	key := string(id) + "\x00" + msg
+	if p.warned[key] {
+		return
+	}
+	if p.warned == nil {
+		p.warned = make(map[string]bool)
+	}
+	p.warned[key] = true
+	p.logger.Warn(msg, append([]interface{}{"id", id}, args...)...)
+}
+
+// serverInfo returns the ExtraServerInfo stored in the server Ext. If the server has no
+// Ext or it has an unexpected type, the info is built from the server metadata as
+// GetServerExt would do. Unexpected types are logged. An empty zone, version or failure
+// domains are filled from the server metadata as well.
+func (p *ImprovedPromoter) serverInfo(extraConfig ExtraConfig, srv ra.Server) ExtraServerInfo {
+	ext, err := toExtraServerInfo(srv.Ext)
+	if err != nil {
+		p.warnServer(srv.ID, "Invalid server ext, building it from the server metadata", "error", err)
+	}
+	if ext == nil {
+		return p.buildServerInfo(extraConfig, srv, ExtraServerInfo{})
+	}
+	if ext.Zone == "" || ext.Version == "" || len(ext.FailureDomains) != len(extraConfig.FailureDomainTags) {
+		built := p.buildServerInfo(extraConfig, srv, *ext)
+		if ext.Zone == "" {
+			ext.Zone = built.Zone
+		}
+		if ext.Version == "" {
+			ext.Version = built.Version
+		}
+		if len(ext.FailureDomains) != len(extraConfig.FailureDomainTags) {
+			ext.FailureDomains = built.FailureDomains
+		}
+	}
+	return *ext
+}
+
 // GetStateExt returns some object that should be stored in the Ext field of the State
 // This value will not be used by the code in this repo but may be used by the other
 // Promoter methods and the application utilizing autopilot. If the value returned is
 // nil the extended state will not be updated.
 func (p *ImprovedPromoter) GetStateExt(config *ra.Config, state *ra.State) interface{} {
-	// TODO: this is left untouched
-	return nil
+	extraConfig := p.startRound(config)
+	return p.buildStateInfo(config, extraConfig, state)
 }
 
 // GetNodeTypes returns a map of ServerID to NodeType for all the servers which
 // should have their NodeType field updated
 func (p *ImprovedPromoter) GetNodeTypes(config *ra.Config, state *ra.State) map[raft.ServerID]ra.NodeType {
-	// TODO: this is left untouched
+	extraConfig := p.startRound(config)
+	zoned := extraConfig.RedundancyZoneTag != ""
+
+	var target *version.Version
+	if !extraConfig.DisableUpgradeMigration {
+		_, target = p.upgradeTarget(config, extraConfig, state)
+	}
+
 	types := make(map[raft.ServerID]ra.NodeType)
-	for id := range state.Servers {
-		// this basic implementation has all nodes be of the "voter" type regardless of
-		// any other settings. That means that in a healthy state all nodes in the cluster
-		// will be a voter.
-		types[id] = ra.NodeVoter
+	for id, srv := range state.Servers {
+		info := p.serverInfo(extraConfig, srv.Server)
+		switch {
+		case info.NonVoter:
+			types[id] = NodeNonVoter
+		case !canVote(extraConfig, info):
+			types[id] = NodeUntagged
+		case target != nil && !srv.HasVotingRights() && info.version() != nil && info.version().Equal(target):
+			types[id] = NodeUpgradePending
+		case zoned && srv.HasVotingRights():
+			types[id] = NodeZoneVoter
+		case zoned && srv.Health.Healthy:
+			types[id] = NodeZoneStandby
+		default:
+			// any other server is a voter or can become one
+			types[id] = ra.NodeVoter
+		}
 	}
 	return types
 }
 
 // CalculatePromotionsAndDemotions return the changes
 func (p *ImprovedPromoter) CalculatePromotionsAndDemotions(config *ra.Config, state *ra.State) ra.RaftChanges {
-	ableServers := make(map[raft.ServerID]*ra.ServerState)
-
-	// filter only those that are stable and can be voters
-	now := time.Now()
-	minStableDuration := state.ServerStabilizationTime(config)
-	for id, server := range state.Servers {
-		// remove nonVoting servers
-		extra := server.Server.Ext.(ExtraServerInfo)
-		if extra.NonVoter {
-			continue
-		}
-
-		// ignore staging state as they are not ready yet
-		if server.State == ra.RaftNonVoter && server.Health.IsStable(now, minStableDuration) {
-			ableServers[id] = server
-		}
-	}
+	extraConfig := p.startRound(config)
+	changes, atomic := p.calculateChanges(config, extraConfig, state)
+	changes = p.limitChanges(config, extraConfig, state, changes, atomic)
+	p.recordPreferredTransfer(state, changes)
+	return changes
+}
 
-	extraConfig := config.Ext.(ExtraConfig)
+// calculateChanges returns the changes needed, before applying the rate limits, and if its promotions
+// must be applied together. That's the case of the upgrade migration, as once any server in the target
+// version is a voter the leadership is transferred and the old voters demoted.
+func (p *ImprovedPromoter) calculateChanges(config *ra.Config, extraConfig ExtraConfig, state *ra.State) (ra.RaftChanges, bool) {
+	ableServers := p.ableServers(config, extraConfig, state)
 
 	// Check if we have to perform upgrade
 	if !extraConfig.DisableUpgradeMigration {
-		changes, canContinue := p.filterByVersion(config, state, ableServers)
+		changes, canContinue := p.filterByVersion(config, extraConfig, state, ableServers)
 		if !canContinue {
 			p.logger.Debug("New changes to do", "promotions", changes.Promotions, "demotions", changes.Demotions, "leader", changes.Leader)
-			return changes
+			return changes, len(changes.Promotions) > 0
 		}
 	}
 
-	// return if nothing else to do
-	if len(ableServers) == 0 {
+	changes := p.filterVoters(config, extraConfig, state, ableServers)
+
+	// move the leadership if there's nothing else to do
+	if len(changes.Promotions) == 0 && len(changes.Demotions) == 0 {
+		changes.Leader = p.preferredLeader(config, extraConfig, state)
+	}
+	if len(changes.Promotions) == 0 && len(changes.Demotions) == 0 && changes.Leader == "" {
 		p.logger.Debug("No raft changes")
-		return ra.RaftChanges{}
+		return changes, false
 	}
+	p.logger.Debug("New changes to do", "promotions", changes.Promotions, "demotions", changes.Demotions, "leader", changes.Leader)
+	return changes, false
+}
+
+// filterVoters returns the changes needed to have the desired voters out of the servers able to vote
+func (p *ImprovedPromoter) filterVoters(config *ra.Config, extraConfig ExtraConfig, state *ra.State, ableServers map[raft.ServerID]*ra.ServerState) ra.RaftChanges {
 
 	// Filter by zone
 	if extraConfig.RedundancyZoneTag != "" {
-		return p.filterByZone(config, state, ableServers)
+		return p.filterByZone(config, extraConfig, state, ableServers)
+	}
+
+	// Limit the number of voters
+	if extraConfig.MaxVoters > 0 || extraConfig.OddVoters {
+		return p.filterByMaxVoters(config, extraConfig, state, ableServers)
 	}
 
 	// add these servers so if we don't change anything those need to be promoted
 	var changes ra.RaftChanges
-	for id := range ableServers {
+	for _, id := range p.rankedServers(ableServers, state) {
 		changes.Promotions = append(changes.Promotions, id)
 	}
-	p.logger.Debug("New changes to do", "promotions", changes.Promotions, "demotions", changes.Demotions, "leader", changes.Leader)
 	return changes
 }
 
+// filterByMaxVoters promotes the most preferred servers up to the maximum number of voters,
+// keeping it odd if required. Voters above it are demoted one at a time, least preferred first.
+// The target comes from the servers that can be voters, failed ones included, so a failure
+// doesn't lower it: standbys replace the failed voters but healthy voters are never demoted.
+func (p *ImprovedPromoter) filterByMaxVoters(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) ra.RaftChanges {
+	candidates := p.rankedServers(filtered, state)
+
+	voters, eligible := 0, 0
+	for _, srv := range state.Servers {
+		switch {
+		case srv.HasVotingRights():
+			eligible++
+			if srv.Health.Healthy {
+				voters++
+			}
+		case canVote(extraConfig, p.serverInfo(extraConfig, srv.Server)):
+			eligible++
+		}
+	}
+
+	target := eligible
+	if extraConfig.MaxVoters > 0 && target > extraConfig.MaxVoters {
+		target = extraConfig.MaxVoters
+	}
+	if extraConfig.MinVoters > target {
+		p.logger.Warn("Maximum number of voters is lower than the minimum, using the minimum", "max", extraConfig.MaxVoters, "min", extraConfig.MinVoters)
+		target = extraConfig.MinVoters
+	}
+	if extraConfig.OddVoters && target%2 == 0 && target-1 >= extraConfig.MinVoters && target > 1 {
+		target--
+	}
+
+	var changes ra.RaftChanges
+	switch {
+	case voters < target:
+		// select the candidates that spread the voters across the failure domains
+		pl := newPlacement(len(extraConfig.FailureDomainTags))
+		for _, id := range state.Voters {
+			if srv, ok := state.Servers[id]; ok && srv.Health.Healthy {
+				pl.add(p.serverInfo(extraConfig, srv.Server).FailureDomains)
+			}
+		}
+		infos := make(map[raft.ServerID]ExtraServerInfo)
+		for _, id := range candidates {
+			infos[id] = p.serverInfo(extraConfig, filtered[id].Server)
+		}
+		for voters+len(changes.Promotions) < target {
+			i, ok := selectCandidate(candidates, func(raft.ServerID) bool { return true }, func(a, b raft.ServerID) bool {
+				return pl.less(infos[a].FailureDomains, infos[b].FailureDomains)
+			})
+			if !ok {
+				break
+			}
+			changes.Promotions = append(changes.Promotions, candidates[i])
+			pl.add(infos[candidates[i]].FailureDomains)
+			candidates = append(candidates[:i], candidates[i+1:]...)
+		}
+	case len(state.Voters) > target:
+		// unhealthy voters are demoted first. Below the maximum, to keep the count odd, a voter
+		// is only demoted if the healthy ones left still reach the target.
+		id, ok := p.leastPreferredVoter(state)
+		if !ok {
+			break
+		}
+		healthy := voters
+		if state.Servers[id].Health.Healthy {
+			healthy--
+		}
+		aboveMax := extraConfig.MaxVoters > 0 && len(state.Voters) > extraConfig.MaxVoters
+		if !aboveMax && healthy < target {
+			p.logger.Debug("Not demoting voter, not enough healthy voters left", "id", id, "healthy", voters, "target", target)
+			break
+		}
+		changes.Demotions = append(changes.Demotions, id)
+	}
+	p.logger.Debug("New changes to do", "voters", voters, "target", target, "promotions", changes.Promotions, "demotions", changes.Demotions, "leader", changes.Leader)
+	return changes
+}
+
+// leastPreferredVoter returns the least preferred voter that isn't the leader, unhealthy ones
+// first, as long as the remaining healthy voters keep quorum without it
+func (p *ImprovedPromoter) leastPreferredVoter(state *ra.State) (raft.ServerID, bool) {
+	voters := make([]raft.ServerID, 0, len(state.Voters))
+	healthy := 0
+	for _, id := range state.Voters {
+		srv, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		voters = append(voters, id)
+		if srv.Health.Healthy {
+			healthy++
+		}
+	}
+	rankServers(voters, state, p.ranker)
+	sort.SliceStable(voters, func(i, j int) bool {
+		return state.Servers[voters[i]].Health.Healthy && !state.Servers[voters[j]].Health.Healthy
+	})
+	for i := len(voters) - 1; i >= 0; i-- {
+		id := voters[i]
+		if id == state.Leader {
+			continue
+		}
+		if state.Servers[id].Health.Healthy {
+			healthy--
+		}
+		if healthy < (len(voters)-1)/2+1 {
+			p.logger.Debug("Not demoting voter, quorum would be lost", "id", id)
+			return "", false
+		}
+		return id, true
+	}
+	return "", false
+}
+
 // FilterFailedServerRemovals takes in the current state and structure outlining all the
 // failed/stale servers and will return those failed servers which the promoter thinks
 // should be allowed to be removed.
 func (p *ImprovedPromoter) FilterFailedServerRemovals(config *ra.Config, state *ra.State, failed *ra.FailedServers) *ra.FailedServers {
-	// TODO: this is left untouched
-	return failed
+	if failed == nil {
+		return nil
+	}
+	extraConfig := p.startRound(config)
+
+	// during an upgrade migration we don't want to remove servers in the target version
+	var target *version.Version
+	if !extraConfig.DisableUpgradeMigration {
+		_, target = p.upgradeTarget(config, extraConfig, state)
+	}
+
+	filtered := &ra.FailedServers{}
+	for _, srv := range failed.FailedVoters {
+		if p.canRemoveServer(extraConfig, state, srv.ID, true, target) {
+			filtered.FailedVoters = append(filtered.FailedVoters, srv)
+		}
+	}
+	for _, srv := range failed.FailedNonVoters {
+		if p.canRemoveServer(extraConfig, state, srv.ID, false, target) {
+			filtered.FailedNonVoters = append(filtered.FailedNonVoters, srv)
+		}
+	}
+	for _, id := range failed.StaleVoters {
+		if p.canRemoveServer(extraConfig, state, id, true, target) {
+			filtered.StaleVoters = append(filtered.StaleVoters, id)
+		}
+	}
+	for _, id := range failed.StaleNonVoters {
+		if p.canRemoveServer(extraConfig, state, id, false, target) {
+			filtered.StaleNonVoters = append(filtered.StaleNonVoters, id)
+		}
+	}
+	return filtered
+}
+
+// canRemoveServer checks if the failed server can be removed. A server can't be removed if it's
+// in the target version of an ongoing upgrade migration or if it's a voter, the last one of its
+// zone, and there isn't any healthy server in the zone to replace it. Untagged servers in their
+// own zone aren't the voter of any zone, so they can always be removed.
+func (p *ImprovedPromoter) canRemoveServer(extraConfig ExtraConfig, state *ra.State, id raft.ServerID, voter bool, target *version.Version) bool {
+	srv, ok := state.Servers[id]
+	if !ok {
+		p.logger.Debug("Allowing removal of failed server", "id", id, "reason", "server not in the autopilot state")
+		return true
+	}
+	info := p.serverInfo(extraConfig, srv.Server)
+
+	if target != nil {
+		if v := info.version(); v != nil && v.Equal(target) {
+			p.logger.Info("Refusing removal of failed server", "id", id, "reason", "server in the upgrade target version", "version", target)
+			return false
+		}
+	}
+
+	// untagged servers don't represent a zone unless they share the default one
+	representsZone := !info.Untagged || untaggedZonePolicy(extraConfig) == UntaggedDefaultZone
+	if voter && extraConfig.RedundancyZoneTag != "" && representsZone {
+		lastVoter, replacement := true, false
+		for otherID, other := range state.Servers {
+			if otherID == id {
+				continue
+			}
+			otherInfo := p.serverInfo(extraConfig, other.Server)
+			if otherInfo.Zone != info.Zone {
+				continue
+			}
+			if other.HasVotingRights() {
+				lastVoter = false
+			}
+			if canVote(extraConfig, otherInfo) && other.Health.Healthy {
+				replacement = true
+			}
+		}
+		if lastVoter && !replacement {
+			p.logger.Info("Refusing removal of failed server", "id", id, "reason", "last voter of its zone without a healthy replacement", "zone", info.Zone)
+			return false
+		}
+	}
+
+	p.logger.Debug("Allowing removal of failed server", "id", id, "reason", "no restrictions apply")
+	return true
 }
 
 type ExtraServerInfo struct {
 	NonVoter bool
 	Zone     string
 	Version  string
+	// Untagged is set if zones are enabled and the server doesn't have the zone tag
+	Untagged bool
+	// NoLeader is set if the server declared it must never receive the leadership
+	NoLeader bool
+	// FailureDomains are the values of the ExtraConfig.FailureDomainTags, in the same order
+	FailureDomains []string
+	// ParsedVersion is the parsed Version, nil if it's invalid
+	ParsedVersion *version.Version
+	// InvalidVersion is set if Version couldn't be parsed
+	InvalidVersion bool
+	// InvalidNonVoter and InvalidNoLeader are the values of the non voter and no leader tags
+	// that couldn't be parsed, empty if they're valid
+	InvalidNonVoter string
+	InvalidNoLeader string
+}
+
+// version returns the server version or nil if it's not valid
+func (e ExtraServerInfo) version() *version.Version {
+	if e.InvalidVersion {
+		return nil
+	}
+	if e.ParsedVersion != nil {
+		return e.ParsedVersion
+	}
+	v, err := version.NewVersion(e.Version)
+	if err != nil {
+		return nil
+	}
+	return v
 }
 
 type ExtraConfig struct {
 	RedundancyZoneTag       string
 	DisableUpgradeMigration bool
 	UpgradeVersionTag       string
+	// UpgradeMode sets how the upgrade migration is performed, UpgradeModeBulk if not set
+	UpgradeMode UpgradeMode
+	// PauseUpgradeMigration freezes the upgrade migration in its current phase, no changes are made
+	// until it's resumed by setting it back to false
+	PauseUpgradeMigration bool
+	// UpgradeTargetVersion pins the version the voters are moved to instead of the higher version found
+	UpgradeTargetVersion string
+	// UpgradeMaxTrailingLogs is the maximum number of log entries a server in the target version can be
+	// behind the leader to be promoted or receive the leadership during the upgrade migration, 0 to disable it
+	UpgradeMaxTrailingLogs uint64
+	// UpgradeMaxLastContact is the maximum time since the last contact with the leader of a server in the
+	// target version to be promoted or receive the leadership during the upgrade migration, 0 to disable it
+	UpgradeMaxLastContact time.Duration
+	// UpgradeDirection sets if the voters are moved to the higher or the lower version found when there's
+	// no UpgradeTargetVersion, UpgradeDirectionUp if not set
+	UpgradeDirection UpgradeDirection
+	// UntaggedZonePolicy sets how servers without the zone tag are handled, UntaggedOwnZone if not set
+	UntaggedZonePolicy UntaggedZonePolicy
+	// FailureDomainTags are the meta keys of the failure domains the servers are in, from the
+	// top level to the bottom one (e.g. region, zone, rack). Voters are spread across the
+	// failure domains, maximising the diversity at the top level first.
+	FailureDomainTags []string
+	// VotersPerZone is the number of voters each redundancy zone should have, 1 if not set
+	VotersPerZone int
+	// ZoneVoters overrides VotersPerZone for the given zones
+	ZoneVoters map[string]int
+	// ZoneWeights are the weights of the zones, 1 if not set. When extra voters are needed,
+	// the zones with fewer voters for their weight are preferred. Weights only rank the zones.
+	// With three or more zones, no zone is allowed to hold the majority of the voters.
+	ZoneWeights map[string]float64
+	// MinVoters is the minimum number of voters. If the zones don't provide enough voters
+	// extra ones are promoted, spread across zones, and demotions below it are refused.
+	MinVoters int
+	// MaxVoters is the maximum number of voters when redundancy zones are not used, 0 means
+	// no limit. Servers above it are kept as non voters.
+	MaxVoters int
+	// OddVoters keeps an odd number of voters when redundancy zones are not used
+	OddVoters bool
+	// NonVoterTag is the meta key used by servers to declare themselves as non voters.
+	// If empty, the one provided with WithNonVoterTag is used.
+	NonVoterTag string
+	// NoLeaderTag is the meta key used by servers to declare they must never receive the
+	// leadership (e.g. no-leader=true), for example when they run on weaker hardware
+	NoLeaderTag string
+	// PreferredLeaderTag is the meta key used by servers to declare they're preferred as leader
+	// (e.g. preferred-leader=true)
+	PreferredLeaderTag string
+	// PreferredLeaderZones are the zones whose servers are preferred as leader
+	PreferredLeaderZones []string
+	// PreferredLeaderServers are the IDs of the servers preferred as leader
+	PreferredLeaderServers []raft.ServerID
+	// LeaderPreferenceDelay is how long the leader must be not preferred before the leadership is
+	// transferred to a preferred server
+	LeaderPreferenceDelay time.Duration
+	// LeaderTransferCooldown is the minimum time between leadership transfers to preferred servers
+	LeaderTransferCooldown time.Duration
+	// ServerChangeInterval is the minimum time between changes (promotion, demotion or leadership
+	// transfer) of the same server, 0 to disable it
+	ServerChangeInterval time.Duration
+	// ChangeInterval is the minimum time between changes in the cluster, 0 to disable it
+	ChangeInterval time.Duration
+	// MaxChangesPerWindow is the maximum number of changes in ChangeWindow, 0 to disable it
+	MaxChangesPerWindow int
+	// ChangeWindow is the window of time in which MaxChangesPerWindow applies
+	ChangeWindow time.Duration
+}
+
+// rankedServers returns the IDs of the given servers, most preferred first, as sorted by the ranker
+func (p *ImprovedPromoter) rankedServers(servers map[raft.ServerID]*ra.ServerState, state *ra.State) []raft.ServerID {
+	ids := make([]raft.ServerID, 0, len(servers))
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	rankServers(ids, state, p.ranker)
+	return ids
+}
+
+// UntaggedZonePolicy is how the servers without the zone tag are handled when redundancy zones are enabled
+type UntaggedZonePolicy string
+
+const (
+	// UntaggedOwnZone puts each untagged server in its own zone, named as the server ID
+	UntaggedOwnZone UntaggedZonePolicy = "own-zone"
+	// UntaggedDefaultZone puts all untagged servers in the DefaultZone
+	UntaggedDefaultZone UntaggedZonePolicy = "default-zone"
+	// UntaggedIneligible doesn't promote untagged servers. Those that are voters already are kept.
+	UntaggedIneligible UntaggedZonePolicy = "ineligible"
+)
+
+// DefaultZone is the zone of the untagged servers with the UntaggedDefaultZone policy
+const DefaultZone = "default"
+
+// untaggedZonePolicy returns the policy for untagged servers, UntaggedOwnZone if not set
+func untaggedZonePolicy(extraConfig ExtraConfig) UntaggedZonePolicy {
+	if extraConfig.UntaggedZonePolicy == "" {
+		return UntaggedOwnZone
+	}
+	return extraConfig.UntaggedZonePolicy
+}
+
+// canVote returns whether the server can be promoted to voter
+func canVote(extraConfig ExtraConfig, info ExtraServerInfo) bool {
+	if info.NonVoter {
+		return false
+	}
+	return !info.Untagged || untaggedZonePolicy(extraConfig) != UntaggedIneligible
+}
+
+// nonVoterTagFor returns the non voter tag to use with the given config
+func (p *ImprovedPromoter) nonVoterTagFor(extraConfig ExtraConfig) string {
+	if extraConfig.NonVoterTag != "" {
+		return extraConfig.NonVoterTag
+	}
+	return p.nonVoterTag
+}
+
+// ableServers returns the non voters that are stable and can be voters
+func (p *ImprovedPromoter) ableServers(config *ra.Config, extraConfig ExtraConfig, state *ra.State) map[raft.ServerID]*ra.ServerState {
+	ableServers := make(map[raft.ServerID]*ra.ServerState)
+
+	// filter only those that are stable and can be voters
+	now := p.now()
+	minStableDuration := state.ServerStabilizationTime(config)
+	for id, server := range state.Servers {
+		// remove nonVoting servers
+		extra := p.serverInfo(extraConfig, server.Server)
+		if !canVote(extraConfig, extra) {
+			continue
+		}
+
+		// ignore staging state as they are not ready yet
+		if server.State == ra.RaftNonVoter && server.Health.IsStable(now, minStableDuration) {
+			ableServers[id] = server
+		}
+	}
+	return ableServers
 }
 
-func (p *ImprovedPromoter) filterByVersion(config *ra.Config, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) (ra.RaftChanges, bool) {
-	versions, hv, lv := getVersionInfo(config, state)
-	switch len(versions) {
-	case 1: // nothing to do
+func (p *ImprovedPromoter) filterByVersion(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) (ra.RaftChanges, bool) {
+	upgrade, changes := p.planUpgrade(config, extraConfig, state, filtered)
+	p.trackUpgrade(upgrade)
+	if upgrade.TargetVersion == "" { // nothing to do
 		return ra.RaftChanges{}, true
-	case 2:
-		changes := p.performVersionUpgrade(config, state, filtered, hv, lv)
-		return changes, false
-	default: // more than 2
+	}
+	if upgrade.Paused { // freeze the migration in its current phase
+		p.logger.Debug("Upgrade migration paused, no changes", "phase", upgrade.Phase, "target", upgrade.TargetVersion)
 		return ra.RaftChanges{}, false
-		// THINK: we could do the case of 2 or more.
-		// The logic would be to select the higher version servers vs old others
 	}
+	return changes, false
 }
 
-func (p *ImprovedPromoter) filterByZone(config *ra.Config, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) ra.RaftChanges {
-	zoneVoter := make(map[string]struct{})
+func (p *ImprovedPromoter) filterByZone(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) ra.RaftChanges {
+	now := p.now()
+	minStableDuration := state.ServerStabilizationTime(config)
+
+	// only healthy voters cover their zone, unhealthy ones are replaced
+	zoneVoters := make(map[string]int)
+	zoneStableVoters := make(map[string]int)
+	unhealthyVoters := make(map[raft.ServerID]string)
+	pl := newPlacement(len(extraConfig.FailureDomainTags))
 	for _, srvID := range state.Voters {
-		srv := state.Servers[srvID]
-		zone := serverZone(srv.Server)
-		zoneVoter[zone] = struct{}{}
+		srv, ok := state.Servers[srvID]
+		if !ok {
+			continue
+		}
+		info := p.serverInfo(extraConfig, srv.Server)
+		zone := info.Zone
+		if !srv.Health.Healthy {
+			unhealthyVoters[srvID] = zone
+			continue
+		}
+		zoneVoters[zone]++
+		pl.add(info.FailureDomains)
+		if srv.Health.IsStable(now, minStableDuration) {
+			zoneStableVoters[zone]++
+		}
 	}
 
 	var changes ra.RaftChanges
-	for id, srv := range filtered {
-		zone := serverZone(srv.Server)
-		if _, ok := zoneVoter[zone]; !ok {
-			changes.Promotions = append(changes.Promotions, id)
-			zoneVoter[zone] = struct{}{}
+	healthyVoters := 0
+	for _, count := range zoneVoters {
+		healthyVoters += count
+	}
+	candidates := p.rankedServers(filtered, state)
+	infos := make(map[raft.ServerID]ExtraServerInfo)
+	for _, id := range candidates {
+		infos[id] = p.serverInfo(extraConfig, filtered[id].Server)
+	}
+	promote := func(i int) {
+		id := candidates[i]
+		changes.Promotions = append(changes.Promotions, id)
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		zoneVoters[infos[id].Zone]++
+		healthyVoters++
+		pl.add(infos[id].FailureDomains)
+	}
+	moreDiverse := func(a, b raft.ServerID) bool {
+		return pl.less(infos[a].FailureDomains, infos[b].FailureDomains)
+	}
+
+	// with three or more zones, a single zone can't hold the majority of the voters, as losing
+	// it would lose the quorum. While selecting, a zone can only get a voter if it doesn't hold
+	// more than the rest, so other zones can even it out, and the final layout is checked below.
+	// With two zones, one of them always holds the majority of an odd number of voters, so the
+	// zone targets and the minimum are honoured. Only the zones that have or can get voters count.
+	zones := make(map[string]struct{})
+	for zone := range zoneVoters {
+		zones[zone] = struct{}{}
+	}
+	for _, info := range infos {
+		zones[info.Zone] = struct{}{}
+	}
+	checkMajority := len(zones) > 2
+	keepsMinority := func(id raft.ServerID) bool {
+		zone := infos[id].Zone
+		if !checkMajority || zoneVoters[zone]*2 <= healthyVoters {
+			return true
+		}
+		p.logger.Debug("Not promoting server, its zone would hold the majority of the voters", "id", id, "zone", zone)
+		return false
+	}
+
+	// promote servers in the zones without enough voters
+	for {
+		i, ok := selectCandidate(candidates, func(id raft.ServerID) bool {
+			zone := infos[id].Zone
+			return zoneVoters[zone] < p.zoneVoters(extraConfig, zone) && keepsMinority(id)
+		}, moreDiverse)
+		if !ok {
+			break
+		}
+		promote(i)
+	}
+
+	// if the zones don't provide enough voters, add extra ones spreading them across zones
+	for healthyVoters < extraConfig.MinVoters {
+		i, ok := selectCandidate(candidates, keepsMinority, func(a, b raft.ServerID) bool {
+			if c := pl.compare(infos[a].FailureDomains, infos[b].FailureDomains); c != 0 {
+				return c < 0
+			}
+			// prefer the zones with fewer voters for their weight
+			za, zb := infos[a].Zone, infos[b].Zone
+			ra, rb := float64(zoneVoters[za])/p.zoneWeight(extraConfig, za), float64(zoneVoters[zb])/p.zoneWeight(extraConfig, zb)
+			if ra != rb {
+				return ra < rb
+			}
+			if zoneVoters[za] != zoneVoters[zb] {
+				return zoneVoters[za] < zoneVoters[zb]
+			}
+			return za < zb
+		})
+		if !ok {
+			p.logger.Debug("Not enough servers to reach the minimum number of voters", "voters", healthyVoters, "min", extraConfig.MinVoters)
+			break
+		}
+		promote(i)
+	}
+
+	// drop the last promotions of a zone that would hold the majority of the voters
+	for i := len(changes.Promotions) - 1; i >= 0 && checkMajority; i-- {
+		id := changes.Promotions[i]
+		zone := infos[id].Zone
+		if zoneVoters[zone]*2 <= healthyVoters {
+			continue
+		}
+		p.logger.Debug("Not promoting server, its zone would hold the majority of the voters", "id", id, "zone", zone)
+		changes.Promotions = append(changes.Promotions[:i], changes.Promotions[i+1:]...)
+		zoneVoters[zone]--
+		healthyVoters--
+	}
+
+	if len(zones) == 2 && len(changes.Promotions) > 0 {
+		for zone, count := range zoneVoters {
+			if count*2 > healthyVoters {
+				p.logger.Warn("Only two zones, losing the zone with the majority of the voters will lose the quorum", "zone", zone, "voters", count, "total", healthyVoters)
+			}
+		}
+	}
+
+	// demote the unhealthy voters once their replacements are stable voters, as long as
+	// the minimum number of voters is kept
+	unhealthyIDs := make([]raft.ServerID, 0, len(unhealthyVoters))
+	for id := range unhealthyVoters {
+		unhealthyIDs = append(unhealthyIDs, id)
+	}
+	ra.SortServers(unhealthyIDs, state)
+	for _, id := range unhealthyIDs {
+		zone := unhealthyVoters[id]
+		if zoneStableVoters[zone] < p.zoneVoters(extraConfig, zone) || id == state.Leader {
+			continue
+		}
+		if len(state.Voters)-len(changes.Demotions) <= extraConfig.MinVoters {
+			p.logger.Debug("Not demoting unhealthy voter below the minimum number of voters", "id", id, "min", extraConfig.MinVoters)
+			continue
 		}
+		changes.Demotions = append(changes.Demotions, id)
 	}
+
+	// once every zone is covered, demote the surplus voters one at a time
+	if len(changes.Promotions) == 0 && len(changes.Demotions) == 0 {
+		if id, ok := p.surplusZoneVoter(config, extraConfig, state); ok {
+			changes.Demotions = append(changes.Demotions, id)
+		}
+	}
+
 	p.logger.Debug("New changes to do", "promotions", changes.Promotions, "demotions", changes.Demotions, "leader", changes.Leader)
 	return changes
 }
 
-func (p *ImprovedPromoter) performVersionUpgrade(config *ra.Config, state *ra.State, filtered map[raft.ServerID]*ra.ServerState, hv, lv *version.Version) ra.RaftChanges {
-	var changes ra.RaftChanges
-	var highVersionVoter, lowVersionVoter, highVersionLeader bool
+// zoneVoters returns the number of voters the zone should have
+func (p *ImprovedPromoter) zoneVoters(extraConfig ExtraConfig, zone string) int {
+	if voters, ok := extraConfig.ZoneVoters[zone]; ok && voters >= 0 {
+		return voters
+	}
+	if extraConfig.VotersPerZone > 0 {
+		return extraConfig.VotersPerZone
+	}
+	return 1
+}
+
+// zoneWeight returns the weight of the zone, 1 if not set
+func (p *ImprovedPromoter) zoneWeight(extraConfig ExtraConfig, zone string) float64 {
+	if weight, ok := extraConfig.ZoneWeights[zone]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// surplusZoneVoter returns the least preferred voter of the zone with more surplus voters,
+// as long as demoting it keeps the failure tolerance expected with the voters of all zones
+// and the minimum number of voters.
+func (p *ImprovedPromoter) surplusZoneVoter(config *ra.Config, extraConfig ExtraConfig, state *ra.State) (raft.ServerID, bool) {
 
+	zoneVoters := make(map[string][]raft.ServerID)
+	healthy := 0
 	for _, id := range state.Voters {
-		voter := state.Servers[id]
-		serverInfo := voter.Server.Ext.(ExtraServerInfo)
-		highVersionVoter = highVersionVoter || version.Must(version.NewVersion(serverInfo.Version)).Equal(hv)
-		lowVersionVoter = lowVersionVoter || version.Must(version.NewVersion(serverInfo.Version)).Equal(lv)
+		srv, ok := state.Servers[id]
+		if !ok || !srv.Health.Healthy {
+			continue
+		}
+		zone := p.serverInfo(extraConfig, srv.Server).Zone
+		zoneVoters[zone] = append(zoneVoters[zone], id)
+		healthy++
 	}
-	leader := state.Servers[state.Leader]
-	serverInfo := leader.Server.Ext.(ExtraServerInfo)
-	highVersionLeader = version.Must(version.NewVersion(serverInfo.Version)).Equal(hv)
 
-	p.logger.Debug("Versions info", "highvoter", highVersionVoter, "lowvoter", lowVersionVoter, "highleader", highVersionLeader)
+	zones := make([]string, 0, len(zoneVoters))
+	desired := 0
+	for zone, voters := range zoneVoters {
+		zones = append(zones, zone)
+		target := p.zoneVoters(extraConfig, zone)
+		if len(voters) < target {
+			target = len(voters)
+		}
+		desired += target
+	}
+	sort.Strings(zones)
+
+	if healthy <= extraConfig.MinVoters {
+		return "", false
+	}
+	if desired < extraConfig.MinVoters {
+		desired = extraConfig.MinVoters
+	}
+
+	var candidate raft.ServerID
+	var candidateZone string
+	maxSurplus := 0
+	for _, zone := range zones {
+		voters := zoneVoters[zone]
+		surplus := len(voters) - p.zoneVoters(extraConfig, zone)
+		if surplus <= maxSurplus {
+			continue
+		}
+		// the least preferred voter that isn't the leader
+		rankServers(voters, state, p.ranker)
+		for i := len(voters) - 1; i >= 0; i-- {
+			if voters[i] != state.Leader {
+				candidate, candidateZone, maxSurplus = voters[i], zone, surplus
+				break
+			}
+		}
+	}
+	if candidate == "" {
+		return "", false
+	}
 
-	// if no voters with the low version exist we're upgraded
-	if !lowVersionVoter {
-		return changes
+	// check that the failure tolerance is kept after the demotion
+	minTolerance := failureTolerance(desired, desired)
+	if tolerance := failureTolerance(len(state.Voters)-1, healthy-1); tolerance < minTolerance {
+		p.logger.Debug("Not demoting surplus voter, failure tolerance would be too low", "id", candidate, "zone", candidateZone, "tolerance", tolerance, "required", minTolerance)
+		return "", false
 	}
+	p.logger.Debug("Demoting surplus zone voter", "id", candidate, "zone", candidateZone)
+	return candidate, true
+}
+
+// performVersionUpgrade moves the voters to the target version hv. Servers in any
+// other (valid) version are considered to be in the old version.
+func (p *ImprovedPromoter) performVersionUpgrade(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState, hv *version.Version) (UpgradeState, ra.RaftChanges) {
+	var changes ra.RaftChanges
 
-	// if no voters with the high version, we check that the number of servers is enought
-	if !highVersionVoter {
+	highVersionVoters, lowVersionVoters := p.versionVoters(extraConfig, state, hv)
+	upgrade := UpgradeState{
+		Phase:         p.upgradePhase(extraConfig, state, hv),
+		TargetVersion: hv.String(),
+		OldVoters:     append([]raft.ServerID(nil), lowVersionVoters...),
+	}
+	sortIDs(upgrade.OldVoters)
+	p.logger.Debug("Upgrade phase", "phase", upgrade.Phase, "target", hv)
+
+	if upgrade.Phase != UpgradeNone && extraConfig.UpgradeMode == UpgradeModeZone && extraConfig.RedundancyZoneTag != "" {
+		return p.performZoneUpgrade(config, extraConfig, state, filtered, hv, upgrade)
+	}
+
+	switch upgrade.Phase {
+	case UpgradeNone: // if no voters with the low version exist we're upgraded
+		return upgrade, changes
+	case UpgradeWaiting:
+		// if no voters with the high version, we check that the number of servers is enought
 		usefulHighVersionServers := make([]ra.Server, 0)
-		zones := make(map[string]struct{})
-		checkZone := config.Ext.(ExtraConfig).RedundancyZoneTag != ""
-		for _, srv := range filtered {
-			serverInfo := srv.Server.Ext.(ExtraServerInfo)
-			if !version.Must(version.NewVersion(serverInfo.Version)).Equal(hv) {
+		zones := make(map[string]int)
+		checkZone := extraConfig.RedundancyZoneTag != ""
+		for _, id := range p.rankedServers(filtered, state) {
+			srv := filtered[id]
+			serverInfo := p.serverInfo(extraConfig, srv.Server)
+			if v := serverInfo.version(); v == nil || !v.Equal(hv) {
+				continue
+			}
+			if !p.upgradeReady(extraConfig, state, srv) {
 				continue
 			}
-			if _, ok := zones[serverInfo.Zone]; !checkZone || (checkZone && !ok) {
+			if !checkZone || zones[serverInfo.Zone] < p.zoneVoters(extraConfig, serverInfo.Zone) {
 				usefulHighVersionServers = append(usefulHighVersionServers, srv.Server)
-				zones[serverInfo.Zone] = struct{}{}
+				zones[serverInfo.Zone]++
 			}
 		}
-		if len(usefulHighVersionServers) >= len(state.Voters) {
-			for _, srv := range usefulHighVersionServers {
-				changes.Promotions = append(changes.Promotions, srv.ID)
-			}
+		if len(usefulHighVersionServers) < len(state.Voters) {
+			upgrade.NewServersNeeded = len(state.Voters) - len(usefulHighVersionServers)
+			return upgrade, changes
 		}
-		return changes
-	}
-
-	// If we're here we have servers on both versions as voters, but we need to apply a leadership change
-	if !highVersionLeader {
-		highVersionVoters := make([]raft.ServerID, 0)
-		for _, id := range state.Voters {
-			voter := state.Servers[id]
-			serverInfo := voter.Server.Ext.(ExtraServerInfo)
-			if version.Must(version.NewVersion(serverInfo.Version)).Equal(hv) {
-				highVersionVoters = append(highVersionVoters, id)
-			}
+		upgrade.Phase = UpgradePromoting
+		for _, srv := range usefulHighVersionServers {
+			changes.Promotions = append(changes.Promotions, srv.ID)
 		}
-		ra.SortServers(highVersionVoters, state)
-		changes.Leader = highVersionVoters[0]
-		return changes
+		return upgrade, changes
+	case UpgradeLeaderTransfer:
+		// If we're here we have servers on both versions as voters, but we need to apply a leadership change
+		if leader, ok := p.leaderTransferTarget(extraConfig, state, p.readyServers(extraConfig, state, highVersionVoters)); ok {
+			changes.Leader = leader
+		} else {
+			upgrade.LeaderTransferBlocked = true
+		}
+		return upgrade, changes
 	}
 
-	// we have voters in two versions and a leader in the new version, demote old ones
+	// UpgradeDemoting: we have voters in both the new and old versions and a leader in the new version, demote old ones
+	changes.Demotions = lowVersionVoters
+	ra.SortServers(changes.Demotions, state)
+
+	return upgrade, changes
+}
+
+// upgradePhase returns the phase of the upgrade migration to the target version hv
+func (p *ImprovedPromoter) upgradePhase(extraConfig ExtraConfig, state *ra.State, hv *version.Version) UpgradePhase {
+	var highVersionVoter, lowVersionVoter, highVersionLeader bool
 	for _, id := range state.Voters {
-		voter := state.Servers[id]
-		serverInfo := voter.Server.Ext.(ExtraServerInfo)
-		if version.Must(version.NewVersion(serverInfo.Version)).Equal(lv) {
-			changes.Demotions = append(changes.Demotions, id)
+		voter, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		v := p.serverInfo(extraConfig, voter.Server).version()
+		if v == nil {
+			continue
 		}
+		highVersionVoter = highVersionVoter || v.Equal(hv)
+		lowVersionVoter = lowVersionVoter || !v.Equal(hv)
+	}
+	if leader, ok := state.Servers[state.Leader]; ok {
+		v := p.serverInfo(extraConfig, leader.Server).version()
+		highVersionLeader = v != nil && v.Equal(hv)
 	}
 
-	return changes
+	p.logger.Debug("Versions info", "highvoter", highVersionVoter, "lowvoter", lowVersionVoter, "highleader", highVersionLeader)
+
+	switch {
+	case !lowVersionVoter:
+		return UpgradeNone
+	case !highVersionVoter:
+		return UpgradeWaiting
+	case !highVersionLeader:
+		return UpgradeLeaderTransfer
+	default:
+		return UpgradeDemoting
+	}
 }
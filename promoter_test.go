@@ -0,0 +1,1602 @@
+package autopilot
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+func testPromoter(options ...Option) *ImprovedPromoter {
+	options = append([]Option{WithLogger(hclog.NewNullLogger())}, options...)
+	return New(options...).(*ImprovedPromoter)
+}
+
+// testStableSince is the time since all test servers are stable, so they're sorted by ID
+var testStableSince = time.Now().Add(-time.Hour)
+
+// testServer returns a healthy server, stable for a while, with the given raft state and metadata
+func testServer(id string, state ra.RaftState, meta map[string]string) *ra.ServerState {
+	return &ra.ServerState{
+		Server: ra.Server{
+			ID:         raft.ServerID(id),
+			NodeStatus: ra.NodeAlive,
+			Version:    "1.0.0",
+			Meta:       meta,
+			IsLeader:   state == ra.RaftLeader,
+		},
+		State:  state,
+		Health: ra.ServerHealth{Healthy: true, StableSince: testStableSince},
+	}
+}
+
+// testState returns the autopilot state with the given servers
+func testState(servers ...*ra.ServerState) *ra.State {
+	state := &ra.State{Healthy: true, Servers: make(map[raft.ServerID]*ra.ServerState)}
+	for _, srv := range servers {
+		state.Servers[srv.Server.ID] = srv
+		switch srv.State {
+		case ra.RaftLeader:
+			state.Leader = srv.Server.ID
+			state.Voters = append(state.Voters, srv.Server.ID)
+		case ra.RaftVoter:
+			state.Voters = append(state.Voters, srv.Server.ID)
+		}
+	}
+	return state
+}
+
+// testConfig returns an autopilot config with the given ExtraConfig
+func testConfig(ext interface{}) *ra.Config {
+	return &ra.Config{
+		LastContactThreshold:    5 * time.Second,
+		MaxTrailingLogs:         100,
+		ServerStabilizationTime: 10 * time.Second,
+		Ext:                     ext,
+	}
+}
+
+func TestMalformedExt(t *testing.T) {
+	extraConfig := ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", NonVoterTag: "nonvoter"}
+	configExts := []interface{}{
+		nil,
+		extraConfig,
+		&extraConfig,
+		(*ExtraConfig)(nil),
+		"invalid",
+	}
+	serverExts := []interface{}{
+		nil,
+		ExtraServerInfo{Zone: "1", Version: "1.0.0"},
+		&ExtraServerInfo{Zone: "1", Version: "1.0.0"},
+		(*ExtraServerInfo)(nil),
+		ExtraServerInfo{},
+		42,
+	}
+
+	for _, configExt := range configExts {
+		for _, serverExt := range serverExts {
+			name := fmt.Sprintf("config %#v, server %#v", configExt, serverExt)
+			config := testConfig(configExt)
+			servers := []*ra.ServerState{
+				testServer("a", ra.RaftLeader, map[string]string{"zone": "1", "version": "1.0.0"}),
+				testServer("b", ra.RaftVoter, map[string]string{"zone": "2", "version": "1.0.0"}),
+				testServer("c", ra.RaftNonVoter, map[string]string{"zone": "3", "version": "2.0.0"}),
+				testServer("d", ra.RaftNonVoter, map[string]string{"zone": "3", "version": "1.0.0", "nonvoter": "true"}),
+			}
+			for _, srv := range servers {
+				srv.Server.Ext = serverExt
+			}
+			state := testState(servers...)
+			failed := &ra.FailedServers{FailedVoters: []*ra.Server{&servers[1].Server}}
+
+			// a state whose leader is not in the servers list
+			noLeader := testState(servers[1:]...)
+			noLeader.Leader = "unknown"
+
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s: panic: %v", name, r)
+					}
+				}()
+				p := testPromoter()
+				for _, srv := range servers {
+					p.GetServerExt(config, srv)
+				}
+				for _, s := range []*ra.State{state, noLeader} {
+					p.GetStateExt(config, s)
+					p.GetNodeTypes(config, s)
+					p.CalculatePromotionsAndDemotions(config, s)
+					p.FilterFailedServerRemovals(config, s, failed)
+				}
+			}()
+		}
+	}
+}
+
+func TestMalformedExtWarnings(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	config := testConfig("invalid")
+	servers := []*ra.ServerState{
+		testServer("a", ra.RaftLeader, nil),
+		testServer("b", ra.RaftVoter, nil),
+		testServer("c", ra.RaftNonVoter, nil),
+	}
+	for _, srv := range servers {
+		srv.Server.Ext = 42
+	}
+	state := testState(servers...)
+
+	// the config is resolved once and each server warning is logged once per round
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		p.CalculatePromotionsAndDemotions(config, state)
+		if n := strings.Count(buf.String(), "Invalid autopilot config ext"); n != 1 {
+			t.Errorf("round %d: expected 1 config warning, got %d:\n%s", i, n, buf.String())
+		}
+		if n := strings.Count(buf.String(), "Invalid server ext"); n != len(servers) {
+			t.Errorf("round %d: expected %d server warnings, got %d:\n%s", i, len(servers), n, buf.String())
+		}
+	}
+}
+
+func TestGetServerExtNonVoter(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   ExtraConfig
+		options  []Option
+		meta     map[string]string
+		previous interface{}
+		nonVoter bool
+	}{
+		{
+			name:     "no tag configured keeps previous value",
+			meta:     map[string]string{"nonvoter": "true"},
+			previous: ExtraServerInfo{NonVoter: true},
+			nonVoter: true,
+		},
+		{
+			name:     "tag configured in config",
+			config:   ExtraConfig{NonVoterTag: "nonvoter"},
+			meta:     map[string]string{"nonvoter": "true"},
+			nonVoter: true,
+		},
+		{
+			name:     "tag configured with option",
+			options:  []Option{WithNonVoterTag("nonvoter")},
+			meta:     map[string]string{"nonvoter": "yes"},
+			nonVoter: true,
+		},
+		{
+			name:     "config tag takes precedence over option",
+			config:   ExtraConfig{NonVoterTag: "ap_nonvoter"},
+			options:  []Option{WithNonVoterTag("nonvoter")},
+			meta:     map[string]string{"nonvoter": "true", "ap_nonvoter": "false"},
+			nonVoter: false,
+		},
+		{
+			name:     "tag not present in meta",
+			config:   ExtraConfig{NonVoterTag: "nonvoter"},
+			meta:     map[string]string{},
+			previous: ExtraServerInfo{NonVoter: true},
+			nonVoter: false,
+		},
+		{
+			name:     "invalid value",
+			config:   ExtraConfig{NonVoterTag: "nonvoter"},
+			meta:     map[string]string{"nonvoter": "maybe"},
+			nonVoter: false,
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter(tc.options...)
+		srvState := &ra.ServerState{
+			Server: ra.Server{ID: raft.ServerID("a"), Meta: tc.meta, Ext: tc.previous},
+		}
+		ext := p.GetServerExt(&ra.Config{Ext: tc.config}, srvState).(ExtraServerInfo)
+		if ext.NonVoter != tc.nonVoter {
+			t.Errorf("%s: expected nonvoter %v, got %v", tc.name, tc.nonVoter, ext.NonVoter)
+		}
+	}
+}
+
+func TestGetServerExtVersion(t *testing.T) {
+	cases := []struct {
+		name    string
+		meta    map[string]string
+		version string
+		invalid bool
+	}{
+		{name: "valid version", meta: map[string]string{"version": "v1.2.3"}, version: "1.2.3"},
+		{name: "missing version uses base version", meta: map[string]string{}, version: "0.0.1"},
+		{name: "invalid version", meta: map[string]string{"version": "v1.2.x"}, invalid: true},
+	}
+	p := testPromoter()
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+	for _, tc := range cases {
+		srv := testServer("a", ra.RaftVoter, tc.meta)
+		ext := p.GetServerExt(config, srv).(ExtraServerInfo)
+		if ext.InvalidVersion != tc.invalid {
+			t.Errorf("%s: expected invalid %v, got %v", tc.name, tc.invalid, ext.InvalidVersion)
+		}
+		if tc.invalid {
+			if ext.ParsedVersion != nil {
+				t.Errorf("%s: expected no parsed version, got %s", tc.name, ext.ParsedVersion)
+			}
+			continue
+		}
+		if ext.ParsedVersion == nil || ext.ParsedVersion.String() != tc.version {
+			t.Errorf("%s: expected version %s, got %v", tc.name, tc.version, ext.ParsedVersion)
+		}
+	}
+}
+
+func TestInvalidVersionWarning(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+	srv := testServer("a", ra.RaftVoter, nil)
+
+	// the warning is only logged when the invalid version differs from the previous ext
+	rounds := []struct {
+		version  string
+		warnings int
+	}{
+		{version: "v1.2.x", warnings: 1},
+		{version: "v1.2.x", warnings: 0},
+		{version: "v1.3.x", warnings: 1},
+		{version: "v1.3.0", warnings: 0},
+		{version: "v1.3.x", warnings: 1},
+	}
+	for i, r := range rounds {
+		buf.Reset()
+		srv.Server.Meta = map[string]string{"version": r.version}
+		srv.Server.Ext = p.GetServerExt(config, srv)
+		p.GetStateExt(config, testState(srv))
+		if n := strings.Count(buf.String(), "Invalid server version"); n != r.warnings {
+			t.Errorf("round %d: expected %d warnings, got %d:\n%s", i, r.warnings, n, buf.String())
+		}
+	}
+}
+
+func TestInvalidTagWarning(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	config := testConfig(ExtraConfig{NonVoterTag: "nonvoter", NoLeaderTag: "no-leader"})
+	srv := testServer("a", ra.RaftVoter, nil)
+
+	// the warnings are only logged when the invalid value differs from the previous ext
+	rounds := []struct {
+		nonVoter, noLeader string
+		warnings           int
+	}{
+		{nonVoter: "maybe", noLeader: "perhaps", warnings: 2},
+		{nonVoter: "maybe", noLeader: "perhaps", warnings: 0},
+		{nonVoter: "sometimes", noLeader: "perhaps", warnings: 1},
+		{nonVoter: "false", noLeader: "false", warnings: 0},
+		{nonVoter: "sometimes", noLeader: "perhaps", warnings: 2},
+	}
+	for i, r := range rounds {
+		buf.Reset()
+		srv.Server.Meta = map[string]string{"nonvoter": r.nonVoter, "no-leader": r.noLeader}
+		srv.Server.Ext = p.GetServerExt(config, srv)
+		p.GetStateExt(config, testState(srv))
+		p.CalculatePromotionsAndDemotions(config, testState(srv))
+		if n := strings.Count(buf.String(), "[WARN]"); n != r.warnings {
+			t.Errorf("round %d: expected %d warnings, got %d:\n%s", i, r.warnings, n, buf.String())
+		}
+	}
+}
+
+func TestInvalidVersions(t *testing.T) {
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+
+	cases := []struct {
+		name       string
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+		leader     raft.ServerID
+	}{
+		{
+			name: "invalid non voter, same version cluster",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, map[string]string{"version": "1.0.0"}),
+				testServer("b", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				testServer("c", ra.RaftNonVoter, map[string]string{"version": "v1.2.x"}),
+			},
+			promotions: []raft.ServerID{"c"},
+		},
+		{
+			name: "invalid voter ignored when counting servers to upgrade",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, map[string]string{"version": "1.0.0"}),
+				testServer("b", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				testServer("c", ra.RaftVoter, map[string]string{"version": "invalid"}),
+				testServer("d", ra.RaftNonVoter, map[string]string{"version": "2.0.0"}),
+				testServer("e", ra.RaftNonVoter, map[string]string{"version": "2.0.0"}),
+				testServer("f", ra.RaftNonVoter, map[string]string{"version": "2.0.0"}),
+			},
+			promotions: []raft.ServerID{"d", "e", "f"},
+		},
+		{
+			name: "invalid non voter is not counted as new version",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, map[string]string{"version": "1.0.0"}),
+				testServer("b", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				testServer("c", ra.RaftNonVoter, map[string]string{"version": "2.0.0"}),
+				testServer("d", ra.RaftNonVoter, map[string]string{"version": "2.0.x"}),
+			},
+		},
+		{
+			name: "invalid voter is not demoted",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, map[string]string{"version": "2.0.0"}),
+				testServer("b", ra.RaftVoter, map[string]string{"version": "2.0.0"}),
+				testServer("c", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				testServer("d", ra.RaftVoter, map[string]string{"version": "bad"}),
+			},
+			demotions: []raft.ServerID{"c"},
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter()
+		for _, srv := range tc.servers {
+			srv.Server.Ext = p.GetServerExt(config, srv)
+		}
+		changes := p.CalculatePromotionsAndDemotions(config, testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, tc.leader)
+	}
+}
+
+// verifyChanges checks that the changes are exactly the expected ones
+func verifyChanges(t *testing.T, name string, changes ra.RaftChanges, promotions, demotions []raft.ServerID, leader raft.ServerID) {
+	t.Helper()
+	if !equalIDs(changes.Promotions, promotions) {
+		t.Errorf("%s: expected promotions %v, got %v", name, promotions, changes.Promotions)
+	}
+	if !equalIDs(changes.Demotions, demotions) {
+		t.Errorf("%s: expected demotions %v, got %v", name, demotions, changes.Demotions)
+	}
+	if changes.Leader != leader {
+		t.Errorf("%s: expected leader %q, got %q", name, leader, changes.Leader)
+	}
+}
+
+// equalIDs checks that both lists contain the same IDs in the same order
+func equalIDs(a, b []raft.ServerID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMultiVersionUpgrade(t *testing.T) {
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+
+	cases := []struct {
+		name       string
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+		leader     raft.ServerID
+	}{
+		{
+			name: "three versions, not enough new servers",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.1.0")),
+				testServer("d", ra.RaftNonVoter, v("2.0.0")),
+				testServer("e", ra.RaftNonVoter, v("2.0.0")),
+			},
+		},
+		{
+			name: "three versions, enough new servers",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.1.0")),
+				testServer("d", ra.RaftNonVoter, v("2.0.0")),
+				testServer("e", ra.RaftNonVoter, v("2.0.0")),
+				testServer("f", ra.RaftNonVoter, v("2.0.0")),
+			},
+			promotions: []raft.ServerID{"d", "e", "f"},
+		},
+		{
+			name: "three versions, old leader",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.1.0")),
+				testServer("d", ra.RaftVoter, v("2.0.0")),
+				testServer("e", ra.RaftVoter, v("2.0.0")),
+				testServer("f", ra.RaftVoter, v("2.0.0")),
+			},
+			leader: "d",
+		},
+		{
+			name: "three versions, new leader",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.1.0")),
+				testServer("d", ra.RaftLeader, v("2.0.0")),
+				testServer("e", ra.RaftVoter, v("2.0.0")),
+				testServer("f", ra.RaftVoter, v("2.0.0")),
+			},
+			demotions: []raft.ServerID{"a", "b", "c"},
+		},
+		{
+			name: "three versions, old non voters are not promoted",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("2.0.0")),
+				testServer("b", ra.RaftVoter, v("2.0.0")),
+				testServer("c", ra.RaftVoter, v("2.0.0")),
+				testServer("d", ra.RaftNonVoter, v("1.0.0")),
+				testServer("e", ra.RaftNonVoter, v("1.1.0")),
+			},
+		},
+		{
+			name: "four versions, enough new servers",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.2.0")),
+				testServer("d", ra.RaftNonVoter, v("2.0.0")),
+				testServer("e", ra.RaftNonVoter, v("2.0.0")),
+				testServer("f", ra.RaftNonVoter, v("2.0.0")),
+			},
+			promotions: []raft.ServerID{"d", "e", "f"},
+		},
+		{
+			name: "four versions, old leader",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.2.0")),
+				testServer("d", ra.RaftVoter, v("2.0.0")),
+				testServer("e", ra.RaftVoter, v("2.0.0")),
+				testServer("f", ra.RaftVoter, v("2.0.0")),
+			},
+			leader: "d",
+		},
+		{
+			name: "four versions, new leader",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.2.0")),
+				testServer("d", ra.RaftLeader, v("2.0.0")),
+				testServer("e", ra.RaftVoter, v("2.0.0")),
+				testServer("f", ra.RaftVoter, v("2.0.0")),
+				testServer("g", ra.RaftNonVoter, v("1.2.0")),
+			},
+			demotions: []raft.ServerID{"a", "b", "c"},
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter()
+		changes := p.CalculatePromotionsAndDemotions(config, testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, tc.leader)
+	}
+}
+
+// failedServer returns an unhealthy failed server with the given raft state and metadata
+func failedServer(id string, state ra.RaftState, meta map[string]string) *ra.ServerState {
+	srv := testServer(id, state, meta)
+	srv.Server.NodeStatus = ra.NodeFailed
+	srv.Health = ra.ServerHealth{Healthy: false, StableSince: time.Now().Add(-time.Minute)}
+	return srv
+}
+
+func TestFilterFailedServerRemovals(t *testing.T) {
+	zoneConfig := testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version"})
+	meta := func(zone, version string) map[string]string {
+		return map[string]string{"zone": zone, "version": version}
+	}
+
+	t.Run("FailedVoters", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			config   *ra.Config
+			servers  []*ra.ServerState
+			failed   []raft.ServerID
+			expected []raft.ServerID
+		}{
+			{
+				name:   "no zones, removal allowed",
+				config: testConfig(ExtraConfig{}),
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, nil),
+					testServer("b", ra.RaftVoter, nil),
+					failedServer("c", ra.RaftVoter, nil),
+				},
+				failed:   []raft.ServerID{"c"},
+				expected: []raft.ServerID{"c"},
+			},
+			{
+				name:   "last voter of zone without replacement",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					failedServer("c", ra.RaftVoter, meta("3", "1.0.0")),
+					failedServer("d", ra.RaftNonVoter, meta("3", "1.0.0")),
+				},
+				failed: []raft.ServerID{"c"},
+			},
+			{
+				name:   "last voter of zone with healthy replacement",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					failedServer("c", ra.RaftVoter, meta("3", "1.0.0")),
+					testServer("d", ra.RaftNonVoter, meta("3", "1.0.0")),
+				},
+				failed:   []raft.ServerID{"c"},
+				expected: []raft.ServerID{"c"},
+			},
+			{
+				name:   "untagged voter in its own zone",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					failedServer("x", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				},
+				failed:   []raft.ServerID{"x"},
+				expected: []raft.ServerID{"x"},
+			},
+			{
+				name:   "untagged voter, last of the default zone",
+				config: testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", UntaggedZonePolicy: UntaggedDefaultZone}),
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					failedServer("x", ra.RaftVoter, map[string]string{"version": "1.0.0"}),
+				},
+				failed: []raft.ServerID{"x"},
+			},
+			{
+				name:   "other voter in the zone",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					failedServer("b", ra.RaftVoter, meta("1", "1.0.0")),
+					testServer("c", ra.RaftVoter, meta("2", "1.0.0")),
+				},
+				failed:   []raft.ServerID{"b"},
+				expected: []raft.ServerID{"b"},
+			},
+			{
+				name:   "new version voter during upgrade",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					testServer("c", ra.RaftVoter, meta("3", "2.0.0")),
+					failedServer("d", ra.RaftVoter, meta("1", "2.0.0")),
+				},
+				failed: []raft.ServerID{"d"},
+			},
+		}
+		for _, tc := range cases {
+			state := testState(tc.servers...)
+			failed := &ra.FailedServers{}
+			for _, id := range tc.failed {
+				failed.FailedVoters = append(failed.FailedVoters, &state.Servers[id].Server)
+			}
+			result := testPromoter().FilterFailedServerRemovals(tc.config, state, failed)
+			var removed []raft.ServerID
+			for _, srv := range result.FailedVoters {
+				removed = append(removed, srv.ID)
+			}
+			if !equalIDs(removed, tc.expected) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, removed)
+			}
+		}
+	})
+
+	t.Run("FailedNonVoters", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			config   *ra.Config
+			servers  []*ra.ServerState
+			failed   []raft.ServerID
+			expected []raft.ServerID
+		}{
+			{
+				name:   "only non voter of zone can be removed",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					failedServer("c", ra.RaftNonVoter, meta("3", "1.0.0")),
+				},
+				failed:   []raft.ServerID{"c"},
+				expected: []raft.ServerID{"c"},
+			},
+			{
+				name:   "new version non voter during upgrade",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					testServer("c", ra.RaftNonVoter, meta("1", "2.0.0")),
+					failedServer("d", ra.RaftNonVoter, meta("2", "2.0.0")),
+					failedServer("e", ra.RaftNonVoter, meta("2", "1.0.0")),
+				},
+				failed:   []raft.ServerID{"d", "e"},
+				expected: []raft.ServerID{"e"},
+			},
+			{
+				name:   "new version non voter with upgrade migration disabled",
+				config: testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", DisableUpgradeMigration: true}),
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+					testServer("c", ra.RaftNonVoter, meta("1", "2.0.0")),
+					failedServer("d", ra.RaftNonVoter, meta("2", "2.0.0")),
+				},
+				failed:   []raft.ServerID{"d"},
+				expected: []raft.ServerID{"d"},
+			},
+		}
+		for _, tc := range cases {
+			state := testState(tc.servers...)
+			failed := &ra.FailedServers{}
+			for _, id := range tc.failed {
+				failed.FailedNonVoters = append(failed.FailedNonVoters, &state.Servers[id].Server)
+			}
+			result := testPromoter().FilterFailedServerRemovals(tc.config, state, failed)
+			var removed []raft.ServerID
+			for _, srv := range result.FailedNonVoters {
+				removed = append(removed, srv.ID)
+			}
+			if !equalIDs(removed, tc.expected) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, removed)
+			}
+		}
+	})
+
+	t.Run("StaleNonVoters", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			config   *ra.Config
+			servers  []*ra.ServerState
+			stale    []raft.ServerID
+			expected []raft.ServerID
+		}{
+			{
+				name:   "unknown server",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				},
+				stale:    []raft.ServerID{"z"},
+				expected: []raft.ServerID{"z"},
+			},
+			{
+				name:   "old version non voter during upgrade",
+				config: zoneConfig,
+				servers: []*ra.ServerState{
+					testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+					testServer("b", ra.RaftNonVoter, meta("1", "2.0.0")),
+					failedServer("c", ra.RaftNonVoter, meta("2", "1.0.0")),
+					failedServer("d", ra.RaftNonVoter, meta("2", "2.0.0")),
+				},
+				stale:    []raft.ServerID{"c", "d"},
+				expected: []raft.ServerID{"c"},
+			},
+		}
+		for _, tc := range cases {
+			state := testState(tc.servers...)
+			failed := &ra.FailedServers{StaleNonVoters: tc.stale}
+			result := testPromoter().FilterFailedServerRemovals(tc.config, state, failed)
+			if !equalIDs(result.StaleNonVoters, tc.expected) {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, result.StaleNonVoters)
+			}
+		}
+	})
+}
+
+func TestGetStateExt(t *testing.T) {
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version"})
+	meta := func(zone, version string) map[string]string {
+		return map[string]string{"zone": zone, "version": version}
+	}
+	state := testState(
+		testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+		testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+		testServer("c", ra.RaftVoter, meta("3", "1.0.0")),
+		testServer("d", ra.RaftNonVoter, meta("1", "2.0.0")),
+		testServer("e", ra.RaftNonVoter, meta("2", "2.0.0")),
+		failedServer("f", ra.RaftNonVoter, meta("3", "1.0.0")),
+	)
+
+	info := testPromoter().GetStateExt(config, state).(ExtraStateInfo)
+	expected := ExtraStateInfo{
+		Zones: map[string]ZoneInfo{
+			"1": {Voters: []raft.ServerID{"a"}, NonVoters: []raft.ServerID{"d"}},
+			"2": {Voters: []raft.ServerID{"b"}, NonVoters: []raft.ServerID{"e"}},
+			"3": {Voters: []raft.ServerID{"c"}, NonVoters: []raft.ServerID{"f"}},
+		},
+		ZoneFailureTolerance: 1,
+		UntaggedZonePolicy:   UntaggedOwnZone,
+		Upgrade: UpgradeState{
+			Phase:            UpgradeWaiting,
+			TargetVersion:    "2.0.0",
+			OldVersions:      []string{"1.0.0"},
+			OldVoters:        []raft.ServerID{"a", "b", "c"},
+			NewServersNeeded: 1,
+		},
+		Versions: map[string][]raft.ServerID{
+			"1.0.0": {"a", "b", "c", "f"},
+			"2.0.0": {"d", "e"},
+		},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected %#v, got %#v", expected, info)
+	}
+
+	// without an upgrade migration in progress
+	info = testPromoter().GetStateExt(config, testState(state.Servers["a"], state.Servers["b"], state.Servers["c"])).(ExtraStateInfo)
+	if !reflect.DeepEqual(info.Upgrade, UpgradeState{Phase: UpgradeNone}) {
+		t.Errorf("expected no upgrade, got %#v", info.Upgrade)
+	}
+}
+
+func TestGetNodeTypes(t *testing.T) {
+	meta := func(zone, version, nonVoter string) map[string]string {
+		return map[string]string{"zone": zone, "version": version, "nonvoter": nonVoter}
+	}
+	servers := func() []*ra.ServerState {
+		return []*ra.ServerState{
+			testServer("a", ra.RaftLeader, meta("1", "1.0.0", "")),
+			testServer("b", ra.RaftVoter, meta("2", "1.0.0", "")),
+			testServer("c", ra.RaftNonVoter, meta("1", "1.0.0", "")),
+			failedServer("d", ra.RaftNonVoter, meta("2", "1.0.0", "")),
+			testServer("e", ra.RaftNonVoter, meta("3", "1.0.0", "true")),
+		}
+	}
+
+	cases := []struct {
+		name     string
+		config   ExtraConfig
+		extra    []*ra.ServerState
+		expected map[raft.ServerID]ra.NodeType
+	}{
+		{
+			name:   "no zones",
+			config: ExtraConfig{NonVoterTag: "nonvoter"},
+			expected: map[raft.ServerID]ra.NodeType{
+				"a": ra.NodeVoter, "b": ra.NodeVoter, "c": ra.NodeVoter, "d": ra.NodeVoter, "e": NodeNonVoter,
+			},
+		},
+		{
+			name:   "zones",
+			config: ExtraConfig{NonVoterTag: "nonvoter", RedundancyZoneTag: "zone"},
+			expected: map[raft.ServerID]ra.NodeType{
+				"a": NodeZoneVoter, "b": NodeZoneVoter, "c": NodeZoneStandby, "d": ra.NodeVoter, "e": NodeNonVoter,
+			},
+		},
+		{
+			name:   "upgrade in progress",
+			config: ExtraConfig{NonVoterTag: "nonvoter", RedundancyZoneTag: "zone", UpgradeVersionTag: "version"},
+			extra: []*ra.ServerState{
+				testServer("f", ra.RaftNonVoter, meta("3", "2.0.0", "")),
+				testServer("g", ra.RaftNonVoter, meta("3", "2.0.0", "true")),
+			},
+			expected: map[raft.ServerID]ra.NodeType{
+				"a": NodeZoneVoter, "b": NodeZoneVoter, "c": NodeZoneStandby, "d": ra.NodeVoter, "e": NodeNonVoter,
+				"f": NodeUpgradePending, "g": NodeNonVoter,
+			},
+		},
+	}
+	for _, tc := range cases {
+		state := testState(append(servers(), tc.extra...)...)
+		types := testPromoter().GetNodeTypes(testConfig(tc.config), state)
+		if !reflect.DeepEqual(types, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, types)
+		}
+	}
+}
+
+func TestDeterministicPromotions(t *testing.T) {
+	meta := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+	servers := func() []*ra.ServerState {
+		servers := []*ra.ServerState{
+			testServer("a", ra.RaftLeader, meta("1")),
+			testServer("e", ra.RaftNonVoter, meta("2")),
+			testServer("c", ra.RaftNonVoter, meta("2")),
+			testServer("d", ra.RaftNonVoter, meta("3")),
+			testServer("b", ra.RaftNonVoter, meta("3")),
+		}
+		// d has been stable for longer so it's preferred in its zone
+		servers[3].Health.StableSince = testStableSince.Add(-time.Hour)
+		return servers
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		promotions []raft.ServerID
+	}{
+		{
+			name:       "no zones",
+			promotions: []raft.ServerID{"d", "b", "c", "e"},
+		},
+		{
+			name:       "zones",
+			config:     ExtraConfig{RedundancyZoneTag: "zone"},
+			promotions: []raft.ServerID{"d", "c"},
+		},
+	}
+	for _, tc := range cases {
+		for i := 0; i < 20; i++ {
+			changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(servers()...))
+			verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+		}
+	}
+}
+
+func TestFilterByZone(t *testing.T) {
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone"})
+	zone := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+	recentlyStable := func(srv *ra.ServerState) *ra.ServerState {
+		srv.Health.StableSince = time.Now()
+		return srv
+	}
+
+	cases := []struct {
+		name       string
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+	}{
+		{
+			name: "voter in all zones, no promotions",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftNonVoter, zone("1")),
+				testServer("b", ra.RaftLeader, zone("1")),
+			},
+		},
+		{
+			name: "voter in non existent zone, one promotion",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftNonVoter, zone("1")),
+				testServer("b", ra.RaftLeader, zone("2")),
+			},
+			promotions: []raft.ServerID{"a"},
+		},
+		{
+			name: "voter zone with failing server, one promotion",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftNonVoter, zone("1")),
+				failedServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+			},
+			promotions: []raft.ServerID{"a"},
+		},
+		{
+			name: "voter zone with failing no voter, one promotion",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftNonVoter, zone("1")),
+				failedServer("b", ra.RaftNonVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+			},
+			promotions: []raft.ServerID{"a"},
+		},
+		{
+			name: "non voter in zone, one promotion, multiple non voters",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftNonVoter, zone("1")),
+				failedServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+				testServer("f", ra.RaftNonVoter, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+				testServer("e", ra.RaftNonVoter, zone("3")),
+			},
+			promotions: []raft.ServerID{"a"},
+		},
+		{
+			name: "replacement is a stable voter, failed voter demoted",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, zone("1")),
+				failedServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+			},
+			demotions: []raft.ServerID{"b"},
+		},
+		{
+			name: "replacement voter not stable yet, no demotion",
+			servers: []*ra.ServerState{
+				recentlyStable(testServer("a", ra.RaftVoter, zone("1"))),
+				failedServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+			},
+		},
+		{
+			name: "no replacement, no demotion",
+			servers: []*ra.ServerState{
+				failedServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftLeader, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(config, testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, "")
+	}
+}
+
+func TestSurplusZoneVoters(t *testing.T) {
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone"})
+	zone := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+
+	cases := []struct {
+		name       string
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+	}{
+		{
+			name: "one surplus voter",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+			},
+			demotions: []raft.ServerID{"b"},
+		},
+		{
+			name: "several surplus voters, one demotion at a time, leader kept",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+				testServer("d", ra.RaftVoter, zone("2")),
+				testServer("e", ra.RaftLeader, zone("2")),
+			},
+			demotions: []raft.ServerID{"d"},
+		},
+		{
+			name: "pending promotions, no demotion",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+				testServer("d", ra.RaftNonVoter, zone("3")),
+			},
+			promotions: []raft.ServerID{"d"},
+		},
+		{
+			name: "demotion would reduce failure tolerance",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				func() *ra.ServerState {
+					srv := testServer("c", ra.RaftVoter, zone("2"))
+					srv.Health.StableSince = time.Now()
+					return srv
+				}(),
+				failedServer("x", ra.RaftVoter, zone("2")),
+				testServer("d", ra.RaftVoter, zone("3")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(config, testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, "")
+	}
+}
+
+func TestVotersPerZone(t *testing.T) {
+	meta := func(zone, version string) map[string]string {
+		return map[string]string{"zone": zone, "version": version}
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+	}{
+		{
+			name:   "zone override",
+			config: ExtraConfig{RedundancyZoneTag: "zone", ZoneVoters: map[string]int{"1": 2}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, meta("2", "1.0.0")),
+				testServer("e", ra.RaftNonVoter, meta("2", "1.0.0")),
+			},
+			promotions: []raft.ServerID{"b", "d"},
+		},
+		{
+			name:   "zone override can't give the zone the majority with three zones",
+			config: ExtraConfig{RedundancyZoneTag: "zone", ZoneVoters: map[string]int{"1": 3}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, meta("2", "1.0.0")),
+				testServer("f", ra.RaftNonVoter, meta("3", "1.0.0")),
+			},
+			promotions: []raft.ServerID{"d", "b", "f"},
+		},
+		{
+			name:   "global default",
+			config: ExtraConfig{RedundancyZoneTag: "zone", VotersPerZone: 2},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, meta("1", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, meta("2", "1.0.0")),
+				testServer("e", ra.RaftNonVoter, meta("2", "1.0.0")),
+			},
+			promotions: []raft.ServerID{"b", "d", "e"},
+		},
+		{
+			name:   "global default with zone override",
+			config: ExtraConfig{RedundancyZoneTag: "zone", VotersPerZone: 2, ZoneVoters: map[string]int{"2": 1}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, meta("1", "1.0.0")),
+				testServer("c", ra.RaftVoter, meta("2", "1.0.0")),
+				testServer("d", ra.RaftVoter, meta("2", "1.0.0")),
+				testServer("e", ra.RaftVoter, meta("3", "1.0.0")),
+			},
+			demotions: []raft.ServerID{"d"},
+		},
+		{
+			name:   "upgrade counts servers per zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", ZoneVoters: map[string]int{"1": 2}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, meta("1", "1.0.0")),
+				testServer("c", ra.RaftVoter, meta("2", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, meta("1", "2.0.0")),
+				testServer("e", ra.RaftNonVoter, meta("1", "2.0.0")),
+				testServer("f", ra.RaftNonVoter, meta("1", "2.0.0")),
+				testServer("g", ra.RaftNonVoter, meta("2", "2.0.0")),
+			},
+			promotions: []raft.ServerID{"d", "e", "g"},
+		},
+		{
+			name:   "upgrade without enough servers per zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version"},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, meta("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, meta("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, meta("1", "2.0.0")),
+				testServer("e", ra.RaftNonVoter, meta("1", "2.0.0")),
+				testServer("g", ra.RaftNonVoter, meta("2", "2.0.0")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, "")
+	}
+}
+
+func TestMinVoters(t *testing.T) {
+	zone := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+	}{
+		{
+			name:   "two zones, extra voter",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftNonVoter, zone("1")),
+				testServer("c", ra.RaftNonVoter, zone("2")),
+				testServer("d", ra.RaftNonVoter, zone("2")),
+			},
+			promotions: []raft.ServerID{"c", "b"},
+		},
+		{
+			name:   "three zones, extra voter",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 4},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftNonVoter, zone("1")),
+				testServer("c", ra.RaftNonVoter, zone("2")),
+				testServer("d", ra.RaftNonVoter, zone("3")),
+			},
+			promotions: []raft.ServerID{"c", "d", "b"},
+		},
+		{
+			name:   "zone of a non voter not counted",
+			config: ExtraConfig{RedundancyZoneTag: "zone", NonVoterTag: "nv", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, zone("1")),
+				testServer("a2", ra.RaftNonVoter, zone("1")),
+				testServer("a3", ra.RaftNonVoter, zone("1")),
+				testServer("r", ra.RaftNonVoter, map[string]string{"zone": "2", "nv": "true"}),
+			},
+			promotions: []raft.ServerID{"a2", "a3"},
+		},
+		{
+			name:   "two zones with voters and a non voter in a third one",
+			config: ExtraConfig{RedundancyZoneTag: "zone", NonVoterTag: "nv", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, zone("1")),
+				testServer("a2", ra.RaftNonVoter, zone("1")),
+				testServer("b1", ra.RaftNonVoter, zone("2")),
+				testServer("r", ra.RaftNonVoter, map[string]string{"zone": "3", "nv": "true"}),
+			},
+			promotions: []raft.ServerID{"b1", "a2"},
+		},
+		{
+			name:   "extra voters spread across zones",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 5},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftNonVoter, zone("1")),
+				testServer("e", ra.RaftNonVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+				testServer("d", ra.RaftNonVoter, zone("2")),
+				testServer("f", ra.RaftNonVoter, zone("2")),
+				testServer("g", ra.RaftVoter, zone("3")),
+			},
+			promotions: []raft.ServerID{"b", "d"},
+		},
+		{
+			name:   "not enough servers",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 5},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftNonVoter, zone("1")),
+				testServer("c", ra.RaftNonVoter, zone("2")),
+			},
+			promotions: []raft.ServerID{"c", "b"},
+		},
+		{
+			name:   "surplus voter kept for the minimum",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+			},
+		},
+		{
+			name:   "surplus voter demoted above the minimum",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("1")),
+				testServer("d", ra.RaftVoter, zone("1")),
+				testServer("c", ra.RaftVoter, zone("2")),
+			},
+			demotions: []raft.ServerID{"d"},
+		},
+		{
+			name:   "unhealthy voter kept for the minimum",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("1")),
+				testServer("b", ra.RaftVoter, zone("2")),
+				failedServer("c", ra.RaftVoter, zone("2")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, "")
+	}
+}
+
+func TestTwoZonesWarning(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3})
+	state := testState(
+		testServer("a", ra.RaftLeader, map[string]string{"zone": "1"}),
+		testServer("b", ra.RaftNonVoter, map[string]string{"zone": "1"}),
+		testServer("c", ra.RaftNonVoter, map[string]string{"zone": "2"}),
+	)
+
+	changes := p.CalculatePromotionsAndDemotions(config, state)
+	verifyChanges(t, "two zones", changes, []raft.ServerID{"c", "b"}, nil, "")
+	if !strings.Contains(buf.String(), "Only two zones") {
+		t.Errorf("expected two zones warning, got:\n%s", buf.String())
+	}
+}
+
+func TestMaxVoters(t *testing.T) {
+	servers := func(voters, nonVoters int) []*ra.ServerState {
+		servers := []*ra.ServerState{testServer("a", ra.RaftLeader, nil)}
+		for i := 1; i < voters; i++ {
+			servers = append(servers, testServer(fmt.Sprintf("v%d", i), ra.RaftVoter, nil))
+		}
+		for i := 0; i < nonVoters; i++ {
+			servers = append(servers, testServer(fmt.Sprintf("n%d", i), ra.RaftNonVoter, nil))
+		}
+		return servers
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+	}{
+		{
+			name:       "promotions up to the maximum",
+			config:     ExtraConfig{MaxVoters: 5},
+			servers:    servers(1, 9),
+			promotions: []raft.ServerID{"n0", "n1", "n2", "n3"},
+		},
+		{
+			name:    "at the maximum",
+			config:  ExtraConfig{MaxVoters: 5},
+			servers: servers(5, 5),
+		},
+		{
+			name:       "odd voters",
+			config:     ExtraConfig{OddVoters: true},
+			servers:    servers(1, 5),
+			promotions: []raft.ServerID{"n0", "n1", "n2", "n3"},
+		},
+		{
+			name:       "odd voters with even maximum",
+			config:     ExtraConfig{MaxVoters: 4, OddVoters: true},
+			servers:    servers(1, 9),
+			promotions: []raft.ServerID{"n0", "n1"},
+		},
+		{
+			name:      "voters above the maximum, least preferred demoted",
+			config:    ExtraConfig{MaxVoters: 3},
+			servers:   servers(5, 0),
+			demotions: []raft.ServerID{"v4"},
+		},
+		{
+			name:   "unhealthy voter demoted first",
+			config: ExtraConfig{MaxVoters: 3},
+			servers: append(servers(4, 0),
+				failedServer("f", ra.RaftVoter, nil),
+			),
+			demotions: []raft.ServerID{"f"},
+		},
+		{
+			name:   "standby replaces unhealthy voter",
+			config: ExtraConfig{MaxVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftVoter, nil),
+				testServer("d", ra.RaftNonVoter, nil),
+			},
+			promotions: []raft.ServerID{"d"},
+		},
+		{
+			name:   "unhealthy voter demoted once replaced",
+			config: ExtraConfig{MaxVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftVoter, nil),
+				testServer("d", ra.RaftVoter, nil),
+			},
+			demotions: []raft.ServerID{"c"},
+		},
+		{
+			name:   "unhealthy voter at the maximum kept",
+			config: ExtraConfig{MaxVoters: 3},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftVoter, nil),
+			},
+		},
+		{
+			name:   "odd voters with an unhealthy voter",
+			config: ExtraConfig{OddVoters: true},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftVoter, nil),
+			},
+		},
+		{
+			name:   "odd voters with a demoted unhealthy voter",
+			config: ExtraConfig{OddVoters: true},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftNonVoter, nil),
+			},
+		},
+		{
+			name:   "odd voters demote the unhealthy voter",
+			config: ExtraConfig{OddVoters: true},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, nil),
+				testServer("b", ra.RaftVoter, nil),
+				failedServer("c", ra.RaftVoter, nil),
+				testServer("d", ra.RaftVoter, nil),
+			},
+			demotions: []raft.ServerID{"c"},
+		},
+		{
+			name:       "minimum above the maximum",
+			config:     ExtraConfig{MaxVoters: 3, MinVoters: 5},
+			servers:    servers(1, 9),
+			promotions: []raft.ServerID{"n0", "n1", "n2", "n3"},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, "")
+	}
+}
+
+func TestFailureDomains(t *testing.T) {
+	domain := func(region, zone, rack string) map[string]string {
+		return map[string]string{"region": region, "zone": zone, "rack": rack}
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+	}{
+		{
+			name:   "zone voters spread across racks",
+			config: ExtraConfig{RedundancyZoneTag: "zone", VotersPerZone: 2, FailureDomainTags: []string{"region", "zone", "rack"}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, domain("r1", "z1", "k1")),
+				testServer("b", ra.RaftNonVoter, domain("r1", "z1", "k1")),
+				testServer("c", ra.RaftNonVoter, domain("r1", "z1", "k2")),
+			},
+			promotions: []raft.ServerID{"c"},
+		},
+		{
+			name:   "extra voters spread across regions first",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 4, FailureDomainTags: []string{"region", "zone"}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, domain("r1", "z1", "")),
+				testServer("b", ra.RaftVoter, domain("r1", "z2", "")),
+				testServer("c", ra.RaftNonVoter, domain("r1", "z1", "")),
+				testServer("d", ra.RaftNonVoter, domain("r2", "z3", "")),
+				testServer("e", ra.RaftVoter, domain("r2", "z3", "")),
+			},
+			promotions: []raft.ServerID{"d"},
+		},
+		{
+			name:   "maximum voters spread across regions and zones",
+			config: ExtraConfig{MaxVoters: 3, FailureDomainTags: []string{"region", "zone"}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, domain("r1", "z1", "")),
+				testServer("b", ra.RaftNonVoter, domain("r1", "z1", "")),
+				testServer("c", ra.RaftNonVoter, domain("r1", "z2", "")),
+				testServer("d", ra.RaftNonVoter, domain("r2", "z3", "")),
+				testServer("e", ra.RaftNonVoter, domain("r2", "z4", "")),
+			},
+			promotions: []raft.ServerID{"d", "c"},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+	}
+
+	// failure tolerance reported for each level
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone", FailureDomainTags: []string{"region", "zone"}})
+	state := testState(
+		testServer("a", ra.RaftLeader, domain("r1", "z1", "")),
+		testServer("b", ra.RaftVoter, domain("r1", "z2", "")),
+		testServer("c", ra.RaftVoter, domain("r2", "z3", "")),
+		testServer("d", ra.RaftVoter, domain("r2", "z4", "")),
+		testServer("e", ra.RaftVoter, domain("r3", "z5", "")),
+	)
+	info := testPromoter().GetStateExt(config, state).(ExtraStateInfo)
+	expected := []FailureDomainTolerance{
+		{Tag: "region", FailureTolerance: 1},
+		{Tag: "zone", FailureTolerance: 2},
+	}
+	if !reflect.DeepEqual(info.FailureDomains, expected) {
+		t.Errorf("expected failure domains %v, got %v", expected, info.FailureDomains)
+	}
+}
+
+func TestZoneWeights(t *testing.T) {
+	zone := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+	}{
+		{
+			name:   "two zones, extra voter in the heavier zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3, ZoneWeights: map[string]float64{"z1": 2}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("z1")),
+				testServer("b", ra.RaftNonVoter, zone("z1")),
+				testServer("c", ra.RaftNonVoter, zone("z1")),
+				testServer("d", ra.RaftNonVoter, zone("z2")),
+				testServer("e", ra.RaftNonVoter, zone("z2")),
+			},
+			promotions: []raft.ServerID{"d", "b"},
+		},
+		{
+			name:   "three zones, extra voter in the heavier zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 4, ZoneWeights: map[string]float64{"z1": 2}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("z1")),
+				testServer("b", ra.RaftNonVoter, zone("z1")),
+				testServer("c", ra.RaftNonVoter, zone("z2")),
+				testServer("d", ra.RaftNonVoter, zone("z2")),
+				testServer("e", ra.RaftNonVoter, zone("z3")),
+				testServer("f", ra.RaftNonVoter, zone("z3")),
+			},
+			promotions: []raft.ServerID{"c", "e", "b"},
+		},
+		{
+			name:   "two zones with the same weight",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 3, ZoneWeights: map[string]float64{"z1": 1, "z2": 1}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("z1")),
+				testServer("b", ra.RaftNonVoter, zone("z1")),
+				testServer("d", ra.RaftNonVoter, zone("z2")),
+				testServer("e", ra.RaftNonVoter, zone("z2")),
+			},
+			promotions: []raft.ServerID{"d", "b"},
+		},
+		{
+			name:   "three zones, small edge zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 5, ZoneWeights: map[string]float64{"z1": 2, "z3": 0.5}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("z1")),
+				testServer("b", ra.RaftVoter, zone("z2")),
+				testServer("c", ra.RaftVoter, zone("z3")),
+				testServer("d", ra.RaftNonVoter, zone("z1")),
+				testServer("e", ra.RaftNonVoter, zone("z1")),
+				testServer("f", ra.RaftNonVoter, zone("z2")),
+				testServer("g", ra.RaftNonVoter, zone("z3")),
+			},
+			promotions: []raft.ServerID{"d", "f"},
+		},
+		{
+			name:   "five zones, one heavier zone",
+			config: ExtraConfig{RedundancyZoneTag: "zone", MinVoters: 7, ZoneWeights: map[string]float64{"z1": 2}},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, zone("z1")),
+				testServer("b", ra.RaftVoter, zone("z2")),
+				testServer("c", ra.RaftVoter, zone("z3")),
+				testServer("d", ra.RaftVoter, zone("z4")),
+				testServer("e", ra.RaftVoter, zone("z5")),
+				testServer("f", ra.RaftNonVoter, zone("z1")),
+				testServer("g", ra.RaftNonVoter, zone("z1")),
+				testServer("h", ra.RaftNonVoter, zone("z2")),
+				testServer("i", ra.RaftNonVoter, zone("z5")),
+			},
+			promotions: []raft.ServerID{"f", "h"},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter().CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+	}
+}
+
+func TestUntaggedZonePolicy(t *testing.T) {
+	zone := func(zone string) map[string]string {
+		return map[string]string{"zone": zone}
+	}
+	servers := func() []*ra.ServerState {
+		return []*ra.ServerState{
+			testServer("a", ra.RaftLeader, zone("1")),
+			testServer("b", ra.RaftNonVoter, zone("2")),
+			testServer("c", ra.RaftNonVoter, nil),
+			testServer("d", ra.RaftNonVoter, nil),
+		}
+	}
+
+	cases := []struct {
+		name       string
+		policy     UntaggedZonePolicy
+		promotions []raft.ServerID
+		types      map[raft.ServerID]ra.NodeType
+	}{
+		{
+			name:       "default policy, own zone",
+			promotions: []raft.ServerID{"b", "c", "d"},
+			types:      map[raft.ServerID]ra.NodeType{"a": NodeZoneVoter, "b": NodeZoneStandby, "c": NodeZoneStandby, "d": NodeZoneStandby},
+		},
+		{
+			name:       "own zone",
+			policy:     UntaggedOwnZone,
+			promotions: []raft.ServerID{"b", "c", "d"},
+			types:      map[raft.ServerID]ra.NodeType{"a": NodeZoneVoter, "b": NodeZoneStandby, "c": NodeZoneStandby, "d": NodeZoneStandby},
+		},
+		{
+			name:       "default zone",
+			policy:     UntaggedDefaultZone,
+			promotions: []raft.ServerID{"b", "c"},
+			types:      map[raft.ServerID]ra.NodeType{"a": NodeZoneVoter, "b": NodeZoneStandby, "c": NodeZoneStandby, "d": NodeZoneStandby},
+		},
+		{
+			name:       "ineligible",
+			policy:     UntaggedIneligible,
+			promotions: []raft.ServerID{"b"},
+			types:      map[raft.ServerID]ra.NodeType{"a": NodeZoneVoter, "b": NodeZoneStandby, "c": NodeUntagged, "d": NodeUntagged},
+		},
+	}
+	for _, tc := range cases {
+		config := testConfig(ExtraConfig{RedundancyZoneTag: "zone", UntaggedZonePolicy: tc.policy})
+		p := testPromoter()
+		state := testState(servers()...)
+		for _, srv := range state.Servers {
+			srv.Server.Ext = p.GetServerExt(config, srv)
+		}
+
+		changes := p.CalculatePromotionsAndDemotions(config, state)
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+
+		if types := p.GetNodeTypes(config, state); !reflect.DeepEqual(types, tc.types) {
+			t.Errorf("%s: expected types %v, got %v", tc.name, tc.types, types)
+		}
+
+		info := p.GetStateExt(config, state).(ExtraStateInfo)
+		if policy := untaggedZonePolicy(config.Ext.(ExtraConfig)); info.UntaggedZonePolicy != policy {
+			t.Errorf("%s: expected policy %q, got %q", tc.name, policy, info.UntaggedZonePolicy)
+		}
+		if expected := []raft.ServerID{"c", "d"}; !equalIDs(info.UntaggedServers, expected) {
+			t.Errorf("%s: expected untagged servers %v, got %v", tc.name, expected, info.UntaggedServers)
+		}
+		if tc.policy == UntaggedDefaultZone {
+			if zone := info.Zones[DefaultZone]; !equalIDs(zone.NonVoters, []raft.ServerID{"c", "d"}) {
+				t.Errorf("%s: expected untagged servers in the default zone, got %v", tc.name, info.Zones)
+			}
+		}
+	}
+}
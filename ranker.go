@@ -0,0 +1,105 @@
+package autopilot
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+// Ranker decides which servers are preferred when selecting the candidates to be promoted
+// or the voter that receives the leadership
+type Ranker interface {
+	// Less returns true if the server id1 is preferred over the server id2
+	Less(id1, id2 raft.ServerID, state *ra.State) bool
+}
+
+// RankerFunc is an adapter to allow the use of ordinary functions as Rankers
+type RankerFunc func(id1, id2 raft.ServerID, state *ra.State) bool
+
+// Less calls f(id1, id2, state)
+func (f RankerFunc) Less(id1, id2 raft.ServerID, state *ra.State) bool {
+	return f(id1, id2, state)
+}
+
+// StableHealthRanker prefers the servers that have been healthy for longer. It's the
+// ordering used by ra.SortServers and the default ranker.
+func StableHealthRanker() Ranker {
+	return RankerFunc(ra.ServerLessThan)
+}
+
+// LastIndexRanker prefers the servers with the highest last log index
+func LastIndexRanker() Ranker {
+	return RankerFunc(func(id1, id2 raft.ServerID, state *ra.State) bool {
+		srv1, srv2 := state.Servers[id1], state.Servers[id2]
+		if srv1.Stats.LastIndex != srv2.Stats.LastIndex {
+			return srv1.Stats.LastIndex > srv2.Stats.LastIndex
+		}
+		return ra.ServerLessThan(id1, id2, state)
+	})
+}
+
+// LastContactRanker prefers the servers with the lowest time since the last contact with the leader
+func LastContactRanker() Ranker {
+	return RankerFunc(func(id1, id2 raft.ServerID, state *ra.State) bool {
+		srv1, srv2 := state.Servers[id1], state.Servers[id2]
+		if srv1.Stats.LastContact != srv2.Stats.LastContact {
+			return srv1.Stats.LastContact < srv2.Stats.LastContact
+		}
+		return ra.ServerLessThan(id1, id2, state)
+	})
+}
+
+// MetaPriorityRanker prefers the servers with the highest priority set in the given meta
+// tag. Servers without the tag or with a value that isn't an integer have priority 0.
+func MetaPriorityRanker(tag string) Ranker {
+	priority := func(srv *ra.ServerState) int {
+		value, err := strconv.Atoi(srv.Server.Meta[tag])
+		if err != nil {
+			return 0
+		}
+		return value
+	}
+	return RankerFunc(func(id1, id2 raft.ServerID, state *ra.State) bool {
+		p1, p2 := priority(state.Servers[id1]), priority(state.Servers[id2])
+		if p1 != p2 {
+			return p1 > p2
+		}
+		return ra.ServerLessThan(id1, id2, state)
+	})
+}
+
+// ZoneAffinityRanker prefers the servers in the same zone as the current leader. It's meant to be
+// used with WithLeaderRanker to keep the leadership in its zone. The zone is the one in the server
+// ext, so the ExtraConfig.UntaggedZonePolicy is respected. The value of the given meta tag is used
+// for the servers without ext, and servers without zone are never in the leader zone.
+func ZoneAffinityRanker(tag string) Ranker {
+	zoneOf := func(srv *ra.ServerState) string {
+		if ext, err := toExtraServerInfo(srv.Server.Ext); err == nil && ext != nil && ext.Zone != "" {
+			return ext.Zone
+		}
+		return srv.Server.Meta[tag]
+	}
+	return RankerFunc(func(id1, id2 raft.ServerID, state *ra.State) bool {
+		if leader, ok := state.Servers[state.Leader]; ok {
+			if zone := zoneOf(leader); zone != "" {
+				same1 := zoneOf(state.Servers[id1]) == zone
+				same2 := zoneOf(state.Servers[id2]) == zone
+				if same1 != same2 {
+					return same1
+				}
+			}
+		}
+		return ra.ServerLessThan(id1, id2, state)
+	})
+}
+
+// rankServers sorts the given ids, all of them present in the state, with the ranker.
+// Servers are sorted by ID first so the result is always the same for the same state.
+func rankServers(ids []raft.ServerID, state *ra.State, ranker Ranker) {
+	sortIDs(ids)
+	sort.SliceStable(ids, func(i, j int) bool {
+		return ranker.Less(ids[i], ids[j], state)
+	})
+}
@@ -0,0 +1,162 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+func TestRankers(t *testing.T) {
+	servers := []*ra.ServerState{
+		testServer("a", ra.RaftNonVoter, map[string]string{"priority": "1"}),
+		testServer("b", ra.RaftNonVoter, map[string]string{"priority": "5"}),
+		testServer("c", ra.RaftNonVoter, map[string]string{"priority": "invalid"}),
+		testServer("d", ra.RaftNonVoter, nil),
+	}
+	servers[0].Stats = ra.ServerStats{LastIndex: 10, LastContact: 30 * time.Millisecond}
+	servers[1].Stats = ra.ServerStats{LastIndex: 8, LastContact: 10 * time.Millisecond}
+	servers[2].Stats = ra.ServerStats{LastIndex: 12, LastContact: 20 * time.Millisecond}
+	servers[3].Stats = ra.ServerStats{LastIndex: 12, LastContact: 20 * time.Millisecond}
+	servers[3].Health.StableSince = testStableSince.Add(-time.Hour)
+	state := testState(servers...)
+
+	cases := []struct {
+		name     string
+		ranker   Ranker
+		expected []raft.ServerID
+	}{
+		{name: "stable health", ranker: StableHealthRanker(), expected: []raft.ServerID{"d", "a", "b", "c"}},
+		{name: "last index", ranker: LastIndexRanker(), expected: []raft.ServerID{"d", "c", "a", "b"}},
+		{name: "last contact", ranker: LastContactRanker(), expected: []raft.ServerID{"b", "d", "c", "a"}},
+		{name: "meta priority", ranker: MetaPriorityRanker("priority"), expected: []raft.ServerID{"b", "a", "d", "c"}},
+	}
+	for _, tc := range cases {
+		ids := []raft.ServerID{"c", "a", "d", "b"}
+		rankServers(ids, state, tc.ranker)
+		if !equalIDs(ids, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, ids)
+		}
+	}
+}
+
+func TestZoneAffinityRanker(t *testing.T) {
+	servers := func(leader string) []*ra.ServerState {
+		role := func(id string) ra.RaftState {
+			if id == leader {
+				return ra.RaftLeader
+			}
+			return ra.RaftVoter
+		}
+		return []*ra.ServerState{
+			testServer("a", role("a"), map[string]string{"zone": "2"}),
+			testServer("b", role("b"), map[string]string{"zone": "1"}),
+			testServer("c", role("c"), map[string]string{"zone": "1"}),
+			testServer("d", role("d"), nil),
+			testServer("e", role("e"), nil),
+			testServer("f", role("f"), nil),
+		}
+	}
+
+	cases := []struct {
+		name     string
+		servers  []*ra.ServerState
+		config   *ExtraConfig // if set, the servers ext is built with it
+		expected []raft.ServerID
+	}{
+		{
+			name:     "meta tag without ext",
+			servers:  servers("b"),
+			expected: []raft.ServerID{"c", "a", "d", "e"},
+		},
+		{
+			name:     "untagged leader without ext",
+			servers:  servers("f"),
+			expected: []raft.ServerID{"a", "c", "d", "e"},
+		},
+		{
+			name:     "ext zone",
+			servers:  servers("b"),
+			config:   &ExtraConfig{RedundancyZoneTag: "zone"},
+			expected: []raft.ServerID{"c", "a", "d", "e"},
+		},
+		{
+			name:     "untagged leader in its own zone",
+			servers:  servers("f"),
+			config:   &ExtraConfig{RedundancyZoneTag: "zone", UntaggedZonePolicy: UntaggedOwnZone},
+			expected: []raft.ServerID{"a", "c", "d", "e"},
+		},
+		{
+			name:     "untagged leader in the default zone",
+			servers:  servers("f"),
+			config:   &ExtraConfig{RedundancyZoneTag: "zone", UntaggedZonePolicy: UntaggedDefaultZone},
+			expected: []raft.ServerID{"d", "e", "a", "c"},
+		},
+	}
+	for _, tc := range cases {
+		if tc.config != nil {
+			p := testPromoter()
+			for _, srv := range tc.servers {
+				srv.Server.Ext = p.GetServerExt(testConfig(*tc.config), srv)
+			}
+		}
+		state := testState(tc.servers...)
+
+		ids := []raft.ServerID{"e", "d", "c", "a"}
+		rankServers(ids, state, ZoneAffinityRanker("zone"))
+		if !equalIDs(ids, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, ids)
+		}
+	}
+}
+
+func TestWithRanker(t *testing.T) {
+	meta := func(zone, version, priority string) map[string]string {
+		return map[string]string{"zone": zone, "version": version, "priority": priority}
+	}
+	ranker := WithRanker(MetaPriorityRanker("priority"))
+
+	cases := []struct {
+		name       string
+		config     ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+	}{
+		{
+			name: "no zones",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0", "")),
+				testServer("b", ra.RaftNonVoter, meta("2", "1.0.0", "1")),
+				testServer("c", ra.RaftNonVoter, meta("2", "1.0.0", "2")),
+			},
+			promotions: []raft.ServerID{"c", "b"},
+		},
+		{
+			name:   "zones",
+			config: ExtraConfig{RedundancyZoneTag: "zone"},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0", "")),
+				testServer("b", ra.RaftNonVoter, meta("2", "1.0.0", "1")),
+				testServer("c", ra.RaftNonVoter, meta("2", "1.0.0", "2")),
+			},
+			promotions: []raft.ServerID{"c"},
+		},
+		{
+			name:   "upgrade",
+			config: ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version"},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, meta("1", "1.0.0", "")),
+				testServer("b", ra.RaftVoter, meta("2", "1.0.0", "")),
+				testServer("c", ra.RaftNonVoter, meta("1", "2.0.0", "1")),
+				testServer("d", ra.RaftNonVoter, meta("1", "2.0.0", "2")),
+				testServer("e", ra.RaftNonVoter, meta("2", "2.0.0", "")),
+			},
+			promotions: []raft.ServerID{"d", "e"},
+		},
+	}
+	for _, tc := range cases {
+		changes := testPromoter(ranker).CalculatePromotionsAndDemotions(testConfig(tc.config), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+	}
+}
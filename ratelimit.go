@@ -0,0 +1,120 @@
+package autopilot
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+// changeHistory contains the changes made while the server has been the leader
+type changeHistory struct {
+	// leader is the leader when the changes were made, the history is cleared when it changes
+	leader raft.ServerID
+	// last is the time of the last change and servers the time of the last change of each server
+	last    time.Time
+	servers map[raft.ServerID]time.Time
+	// changes has the time of every change, to limit them in ExtraConfig.ChangeWindow
+	changes []time.Time
+}
+
+// hasRateLimits returns true if any limit to the raft changes is configured
+func hasRateLimits(extraConfig ExtraConfig) bool {
+	return extraConfig.ServerChangeInterval > 0 || extraConfig.ChangeInterval > 0 ||
+		(extraConfig.MaxChangesPerWindow > 0 && extraConfig.ChangeWindow > 0)
+}
+
+// limitChanges applies the rate limits to the changes and records the ones that will be applied.
+// Changes of servers changed in the last ExtraConfig.ServerChangeInterval are removed, all of them are
+// held back if there was a change in the last ExtraConfig.ChangeInterval and they're trimmed to what's
+// left of ExtraConfig.MaxChangesPerWindow. If the promotions are atomic (see calculateChanges) they're
+// never split: they're held back until all of them can be applied, which is allowed with an empty window
+// even if there are more than the maximum, so the upgrade migration isn't blocked forever.
+func (p *ImprovedPromoter) limitChanges(config *ra.Config, extraConfig ExtraConfig, state *ra.State, changes ra.RaftChanges, atomic bool) ra.RaftChanges {
+	if !hasRateLimits(extraConfig) {
+		return changes
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	if p.history.leader != state.Leader {
+		p.history = changeHistory{leader: state.Leader, servers: make(map[raft.ServerID]time.Time)}
+	}
+
+	recent := func(id raft.ServerID) bool {
+		last, ok := p.history.servers[id]
+		if ok && now.Sub(last) < extraConfig.ServerChangeInterval {
+			p.logger.Debug("Holding back change, server changed recently", "id", id, "last", last)
+			return true
+		}
+		return false
+	}
+	var limited ra.RaftChanges
+	for _, id := range changes.Promotions {
+		if !recent(id) {
+			limited.Promotions = append(limited.Promotions, id)
+		}
+	}
+	if atomic && len(limited.Promotions) != len(changes.Promotions) {
+		p.logger.Debug("Holding back promotions, they must be applied together", "promotions", changes.Promotions)
+		return ra.RaftChanges{}
+	}
+	for _, id := range changes.Demotions {
+		if !recent(id) {
+			limited.Demotions = append(limited.Demotions, id)
+		}
+	}
+	if changes.Leader != "" && !recent(changes.Leader) {
+		limited.Leader = changes.Leader
+	}
+
+	// autopilot applies the promotions, or the demotions if there are none, or the leadership transfer
+	var applied *[]raft.ServerID
+	leader := []raft.ServerID{limited.Leader}
+	switch {
+	case len(limited.Promotions) > 0:
+		applied = &limited.Promotions
+	case len(limited.Demotions) > 0:
+		applied = &limited.Demotions
+	case limited.Leader != "":
+		applied = &leader
+	default:
+		return limited
+	}
+
+	if !p.history.last.IsZero() && now.Sub(p.history.last) < extraConfig.ChangeInterval {
+		p.logger.Debug("Holding back changes, last change too recent", "last", p.history.last, "changes", len(*applied))
+		return ra.RaftChanges{}
+	}
+	if extraConfig.MaxChangesPerWindow > 0 && extraConfig.ChangeWindow > 0 {
+		inWindow := p.history.changes[:0]
+		for _, t := range p.history.changes {
+			if now.Sub(t) < extraConfig.ChangeWindow {
+				inWindow = append(inWindow, t)
+			}
+		}
+		p.history.changes = inWindow
+
+		budget := extraConfig.MaxChangesPerWindow - len(inWindow)
+		switch {
+		case len(*applied) <= budget:
+		case atomic && len(inWindow) == 0:
+			p.logger.Debug("Allowing promotions above the maximum changes, they must be applied together", "changes", len(*applied), "max", extraConfig.MaxChangesPerWindow)
+		case atomic || budget <= 0:
+			p.logger.Debug("Holding back changes, too many changes in the window", "window", len(inWindow), "changes", len(*applied), "max", extraConfig.MaxChangesPerWindow)
+			return ra.RaftChanges{}
+		default:
+			p.logger.Debug("Trimming changes, too many changes in the window", "window", len(inWindow), "changes", len(*applied), "max", extraConfig.MaxChangesPerWindow)
+			*applied = (*applied)[:budget]
+		}
+	}
+
+	p.history.last = now
+	for _, id := range *applied {
+		p.history.servers[id] = now
+		p.history.changes = append(p.history.changes, now)
+	}
+	return limited
+}
@@ -0,0 +1,149 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+func TestRateLimits(t *testing.T) {
+	type round struct {
+		after      time.Duration
+		leader     string
+		nonVoters  []string
+		promotions []raft.ServerID
+	}
+	// servers returns the state with the leader, a voter and the given non voters
+	servers := func(r round) *ra.State {
+		leader := r.leader
+		if leader == "" {
+			leader = "a"
+		}
+		srvs := []*ra.ServerState{testServer(leader, ra.RaftLeader, nil), testServer("z", ra.RaftVoter, nil)}
+		for _, id := range r.nonVoters {
+			srvs = append(srvs, testServer(id, ra.RaftNonVoter, nil))
+		}
+		return testState(srvs...)
+	}
+
+	cases := []struct {
+		name   string
+		extra  ExtraConfig
+		rounds []round
+	}{
+		{
+			name:  "no limits",
+			extra: ExtraConfig{},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+				{after: time.Second, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+			},
+		},
+		{
+			name:  "server interval",
+			extra: ExtraConfig{ServerChangeInterval: time.Minute},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+				{after: 10 * time.Second, nonVoters: []string{"b", "c"}, promotions: []raft.ServerID{"c"}},
+				{after: 30 * time.Second, nonVoters: []string{"b"}},
+				{after: time.Minute, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+			},
+		},
+		{
+			name:  "cluster interval",
+			extra: ExtraConfig{ChangeInterval: 30 * time.Second},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+				{after: 10 * time.Second, nonVoters: []string{"c"}},
+				{after: 30 * time.Second, nonVoters: []string{"c"}, promotions: []raft.ServerID{"c"}},
+			},
+		},
+		{
+			name:  "changes per window",
+			extra: ExtraConfig{MaxChangesPerWindow: 2, ChangeWindow: 10 * time.Minute},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+				{after: time.Second, nonVoters: []string{"c", "d"}, promotions: []raft.ServerID{"c"}},
+				{after: 2 * time.Second, nonVoters: []string{"d"}},
+				{after: 5 * time.Minute, nonVoters: []string{"d"}},
+				{after: 10 * time.Minute, nonVoters: []string{"d"}, promotions: []raft.ServerID{"d"}},
+			},
+		},
+		{
+			name:  "large changes are trimmed to the maximum",
+			extra: ExtraConfig{MaxChangesPerWindow: 2, ChangeWindow: 10 * time.Minute},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b", "c", "d"}, promotions: []raft.ServerID{"b", "c"}},
+				{after: time.Second, nonVoters: []string{"d"}},
+			},
+		},
+		{
+			name:  "leadership change clears the history",
+			extra: ExtraConfig{ServerChangeInterval: time.Minute, ChangeInterval: time.Minute},
+			rounds: []round{
+				{after: 0, nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+				{after: time.Second, nonVoters: []string{"b"}},
+				{after: 2 * time.Second, leader: "y", nonVoters: []string{"b"}, promotions: []raft.ServerID{"b"}},
+			},
+		},
+	}
+	for _, tc := range cases {
+		start := time.Now()
+		now := start
+		p := testPromoter()
+		p.now = func() time.Time { return now }
+		config := testConfig(tc.extra)
+		for i, r := range tc.rounds {
+			now = start.Add(r.after)
+			changes := p.CalculatePromotionsAndDemotions(config, servers(r))
+			if !equalIDs(changes.Promotions, r.promotions) {
+				t.Errorf("%s, round %d: expected promotions %v, got %v", tc.name, i, r.promotions, changes.Promotions)
+			}
+		}
+	}
+}
+
+func TestRateLimitsUpgrade(t *testing.T) {
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version", MaxChangesPerWindow: 2, ChangeWindow: 10 * time.Minute, ServerChangeInterval: time.Hour})
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+	upgrade := func(nonVoters ...string) *ra.State {
+		servers := []*ra.ServerState{
+			testServer("a", ra.RaftLeader, v("1.0.0")),
+			testServer("b", ra.RaftVoter, v("1.0.0")),
+			testServer("c", ra.RaftVoter, v("1.0.0")),
+		}
+		for _, id := range nonVoters {
+			servers = append(servers, testServer(id, ra.RaftNonVoter, v("2.0.0")))
+		}
+		return testState(servers...)
+	}
+	start := time.Now()
+	now := start
+	p := testPromoter()
+	p.now = func() time.Time { return now }
+
+	rounds := []struct {
+		after      time.Duration
+		state      *ra.State
+		promotions []raft.ServerID
+	}{
+		// a change in the window holds back all the upgrade promotions
+		{after: 0, state: testState(testServer("a", ra.RaftLeader, nil), testServer("x", ra.RaftNonVoter, nil)), promotions: []raft.ServerID{"x"}},
+		{after: time.Second, state: upgrade("d", "e", "f")},
+		// with an empty window all of them are promoted, even above the maximum
+		{after: 10 * time.Minute, state: upgrade("d", "e", "f"), promotions: []raft.ServerID{"d", "e", "f"}},
+		// if any of them can't be changed, none is promoted
+		{after: 30 * time.Minute, state: upgrade("d", "g", "h")},
+	}
+	for i, r := range rounds {
+		now = start.Add(r.after)
+		changes := p.CalculatePromotionsAndDemotions(config, r.state)
+		if !equalIDs(changes.Promotions, r.promotions) {
+			t.Errorf("round %d: expected promotions %v, got %v", i, r.promotions, changes.Promotions)
+		}
+	}
+}
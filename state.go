@@ -0,0 +1,151 @@
+package autopilot
+
+import (
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+// UpgradePhase is the phase in which the upgrade migration is
+type UpgradePhase string
+
+const (
+	// UpgradeNone means there's no upgrade migration in progress
+	UpgradeNone UpgradePhase = "none"
+	// UpgradeWaiting means there aren't enough stable servers in the target version to replace the voters yet
+	UpgradeWaiting UpgradePhase = "waiting"
+	// UpgradePromoting means the servers in the target version are being added as voters
+	UpgradePromoting UpgradePhase = "promoting"
+	// UpgradeLeaderTransfer means the leadership is being transferred to a server in the target version
+	UpgradeLeaderTransfer UpgradePhase = "leader-transfer"
+	// UpgradeDemoting means the voters in the old versions are being demoted
+	UpgradeDemoting UpgradePhase = "demoting"
+)
+
+const (
+	// NodeZoneVoter is a voter that represents its redundancy zone
+	NodeZoneVoter ra.NodeType = "zone-voter"
+	// NodeZoneStandby is a healthy non voter waiting in its redundancy zone to replace the voter
+	NodeZoneStandby ra.NodeType = "zone-standby"
+	// NodeUpgradePending is a non voter in the target version of an upgrade migration waiting to be promoted
+	NodeUpgradePending ra.NodeType = "upgrade-pending"
+	// NodeUntagged is a server without zone that isn't eligible for voting due to the UntaggedIneligible policy
+	NodeUntagged ra.NodeType = "untagged"
+	// NodeNonVoter is a server that declared itself as non voter (read replica) and will never be promoted
+	NodeNonVoter ra.NodeType = "non-voter"
+)
+
+// ExtraStateInfo is the cluster-wide information stored in the Ext field of the autopilot State
+type ExtraStateInfo struct {
+	// Zones contains the voters and non voters of each zone
+	Zones map[string]ZoneInfo
+	// ZoneFailureTolerance is the number of zones that can fail while keeping quorum
+	ZoneFailureTolerance int
+	// UntaggedZonePolicy is the policy applied to the UntaggedServers
+	UntaggedZonePolicy UntaggedZonePolicy
+	// UntaggedServers are the servers without the zone tag
+	UntaggedServers []raft.ServerID
+	// FailureDomains contains the failure tolerance at each level of ExtraConfig.FailureDomainTags
+	FailureDomains []FailureDomainTolerance
+	// Upgrade is the progress of the upgrade migration
+	Upgrade UpgradeState
+	// Versions contains the servers in each version. Servers with invalid versions are not included
+	Versions map[string][]raft.ServerID
+}
+
+// UpgradeState is the progress of the upgrade migration, computed each round
+type UpgradeState struct {
+	// Phase is the current phase of the upgrade migration
+	Phase UpgradePhase
+	// TargetVersion is the version the voters are being moved to, empty if there's no upgrade migration
+	TargetVersion string
+	// OldVersions are the other versions found in the cluster
+	OldVersions []string
+	// OldVoters are the voters still in an old version
+	OldVoters []raft.ServerID
+	// NewServersNeeded is the number of stable servers in the target version still needed to go on
+	NewServersNeeded int
+	// Paused is true if the migration is frozen by ExtraConfig.PauseUpgradeMigration
+	Paused bool
+	// Downgrade is true if some voter is in a version higher than the target
+	Downgrade bool
+	// RaftVersionDowngrade is true if some server in the target version uses a lower raft protocol
+	// version than the voters
+	RaftVersionDowngrade bool
+	// LeaderTransferBlocked is true if no voter in the target version can receive the leadership,
+	// as all of them have the no leader tag or don't pass the readiness gates
+	LeaderTransferBlocked bool
+}
+
+// FailureDomainTolerance is the number of failure domains of a level that can fail while keeping quorum
+type FailureDomainTolerance struct {
+	Tag              string
+	FailureTolerance int
+}
+
+// ZoneInfo contains the servers of a zone
+type ZoneInfo struct {
+	Voters    []raft.ServerID
+	NonVoters []raft.ServerID
+}
+
+// buildStateInfo builds the cluster-wide information from the state
+func (p *ImprovedPromoter) buildStateInfo(config *ra.Config, extraConfig ExtraConfig, state *ra.State) ExtraStateInfo {
+	info := ExtraStateInfo{
+		Zones:    make(map[string]ZoneInfo),
+		Upgrade:  UpgradeState{Phase: UpgradeNone},
+		Versions: make(map[string][]raft.ServerID),
+	}
+
+	healthyZoneVoters := make(map[string]int)
+	healthyDomainVoters := make([]map[string]int, len(extraConfig.FailureDomainTags))
+	for level := range healthyDomainVoters {
+		healthyDomainVoters[level] = make(map[string]int)
+	}
+	for id, srv := range state.Servers {
+		serverInfo := p.serverInfo(extraConfig, srv.Server)
+		zone := info.Zones[serverInfo.Zone]
+		if srv.HasVotingRights() {
+			zone.Voters = append(zone.Voters, id)
+			if srv.Health.Healthy {
+				healthyZoneVoters[serverInfo.Zone]++
+				for level := range healthyDomainVoters {
+					healthyDomainVoters[level][domainPath(serverInfo.FailureDomains, level)]++
+				}
+			}
+		} else {
+			zone.NonVoters = append(zone.NonVoters, id)
+		}
+		info.Zones[serverInfo.Zone] = zone
+
+		if serverInfo.Untagged {
+			info.UntaggedServers = append(info.UntaggedServers, id)
+		}
+		if v := serverInfo.version(); v != nil {
+			info.Versions[v.String()] = append(info.Versions[v.String()], id)
+		}
+	}
+	for name, zone := range info.Zones {
+		sortIDs(zone.Voters)
+		sortIDs(zone.NonVoters)
+		info.Zones[name] = zone
+	}
+	for _, ids := range info.Versions {
+		sortIDs(ids)
+	}
+	sortIDs(info.UntaggedServers)
+	if extraConfig.RedundancyZoneTag != "" {
+		info.UntaggedZonePolicy = untaggedZonePolicy(extraConfig)
+	}
+	info.ZoneFailureTolerance = zoneFailureTolerance(len(state.Voters), healthyZoneVoters)
+	for level, tag := range extraConfig.FailureDomainTags {
+		info.FailureDomains = append(info.FailureDomains, FailureDomainTolerance{
+			Tag:              tag,
+			FailureTolerance: zoneFailureTolerance(len(state.Voters), healthyDomainVoters[level]),
+		})
+	}
+
+	if !extraConfig.DisableUpgradeMigration {
+		info.Upgrade, _ = p.planUpgrade(config, extraConfig, state, p.ableServers(config, extraConfig, state))
+	}
+	return info
+}
@@ -0,0 +1,346 @@
+package autopilot
+
+import (
+	"sort"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+// UpgradeMode is how the upgrade migration is performed
+type UpgradeMode string
+
+const (
+	// UpgradeModeBulk promotes the servers in the target version once there are enough of them
+	// to replace all the voters, transfers the leadership and then demotes all the old voters
+	UpgradeModeBulk UpgradeMode = "bulk"
+	// UpgradeModeZone upgrades one zone per cycle: a stable standby in the target version is
+	// promoted and then the old voter of its zone is demoted. This keeps the number of voters and
+	// the zone coverage during the whole upgrade. It's only used with redundancy zones enabled.
+	UpgradeModeZone UpgradeMode = "zone"
+)
+
+// UpgradeDirection is the version the upgrade migration moves the voters to when there's no pinned target
+type UpgradeDirection string
+
+const (
+	// UpgradeDirectionUp moves the voters to the higher version found
+	UpgradeDirectionUp UpgradeDirection = "up"
+	// UpgradeDirectionDown moves the voters to the lower version found, to roll back a release
+	UpgradeDirectionDown UpgradeDirection = "down"
+)
+
+// zoneUpgrade contains the servers of a zone taking part in the upgrade migration
+type zoneUpgrade struct {
+	oldVoters []raft.ServerID
+	// newVoters are the healthy and stable voters in the target version
+	newVoters  []raft.ServerID
+	candidates []raft.ServerID
+}
+
+// upgradeTarget returns the stable servers grouped by version and the target version of the upgrade
+// migration, nil if there's no migration in progress. The target is ExtraConfig.UpgradeTargetVersion
+// if set, or the higher (lower if the direction is UpgradeDirectionDown) version otherwise.
+func (p *ImprovedPromoter) upgradeTarget(config *ra.Config, extraConfig ExtraConfig, state *ra.State) (map[string][]*ra.ServerState, *version.Version) {
+	versions, target, lower := p.getVersionInfo(config, extraConfig, state)
+	if extraConfig.UpgradeDirection == UpgradeDirectionDown {
+		target = lower
+	}
+	var err error
+	if pinned := extraConfig.UpgradeTargetVersion; pinned != "" {
+		var v *version.Version
+		if v, err = version.NewVersion(pinned); err == nil {
+			target = v
+		}
+	}
+	p.warnInvalidTarget(extraConfig.UpgradeTargetVersion, err)
+	if target == nil {
+		return versions, nil
+	}
+	// there's a migration while any server is in another version
+	for v := range versions {
+		if v != target.String() {
+			return versions, target
+		}
+	}
+	return versions, nil
+}
+
+// warnInvalidTarget logs the error parsing the pinned target version, once per value
+func (p *ImprovedPromoter) warnInvalidTarget(pinned string, err error) {
+	p.warnLock.Lock()
+	defer p.warnLock.Unlock()
+	if err == nil {
+		p.invalidTarget = ""
+		return
+	}
+	if pinned != p.invalidTarget {
+		p.logger.Warn("Invalid upgrade target version, ignoring it", "version", pinned, "error", err)
+		p.invalidTarget = pinned
+	}
+}
+
+// planUpgrade returns the state of the upgrade migration and the changes needed to move it on.
+// Any version other than the target is considered old.
+func (p *ImprovedPromoter) planUpgrade(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState) (UpgradeState, ra.RaftChanges) {
+	versions, hv := p.upgradeTarget(config, extraConfig, state)
+	if hv == nil { // nothing to do
+		return UpgradeState{Phase: UpgradeNone}, ra.RaftChanges{}
+	}
+	p.logger.Debug("Upgrade migration", "versions", len(versions), "target", hv)
+	upgrade, changes := p.performVersionUpgrade(config, extraConfig, state, filtered, hv)
+	upgrade.Paused = extraConfig.PauseUpgradeMigration
+	upgrade.Downgrade, upgrade.RaftVersionDowngrade = p.downgradeRisks(extraConfig, state, versions[hv.String()], hv)
+	for v := range versions {
+		if v != hv.String() {
+			upgrade.OldVersions = append(upgrade.OldVersions, v)
+		}
+	}
+	sortVersions(upgrade.OldVersions)
+	return upgrade, changes
+}
+
+// trackUpgrade stores the upgrade state of this round and logs it if the phase changed
+func (p *ImprovedPromoter) trackUpgrade(upgrade UpgradeState) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if upgrade.Phase != p.upgrade.Phase {
+		p.logger.Info("Upgrade migration phase changed", "from", p.upgrade.Phase, "phase", upgrade.Phase,
+			"target", upgrade.TargetVersion, "oldversions", upgrade.OldVersions, "oldvoters", upgrade.OldVoters,
+			"needed", upgrade.NewServersNeeded)
+	}
+	if upgrade.LeaderTransferBlocked && (!p.upgrade.LeaderTransferBlocked || upgrade.Phase != p.upgrade.Phase) {
+		p.logger.Warn("Upgrade migration stuck, no voter in the target version can receive the leadership, check their no leader tag and readiness",
+			"target", upgrade.TargetVersion)
+	}
+	if upgrade.TargetVersion != p.upgrade.TargetVersion {
+		if upgrade.Downgrade {
+			p.logger.Warn("Upgrade migration to a lower version, check the servers can roll back", "target", upgrade.TargetVersion)
+		}
+		if upgrade.RaftVersionDowngrade {
+			p.logger.Warn("Servers in the target version use a lower raft protocol version than the voters, raft compatibility might be at risk", "target", upgrade.TargetVersion)
+		}
+	}
+	if upgrade.Paused != p.upgrade.Paused && upgrade.TargetVersion != "" {
+		if upgrade.Paused {
+			p.logger.Info("Upgrade migration paused", "phase", upgrade.Phase, "target", upgrade.TargetVersion)
+		} else {
+			p.logger.Info("Upgrade migration resumed", "phase", upgrade.Phase, "target", upgrade.TargetVersion)
+		}
+	}
+	p.upgrade = upgrade
+}
+
+// downgradeRisks returns if any voter is in a version higher than the target hv and if any of the
+// target servers uses a lower raft protocol version than the voters. A zero raft version is unknown.
+func (p *ImprovedPromoter) downgradeRisks(extraConfig ExtraConfig, state *ra.State, targets []*ra.ServerState, hv *version.Version) (bool, bool) {
+	var downgrade bool
+	var raftVersion int
+	for _, id := range state.Voters {
+		voter, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		if v := p.serverInfo(extraConfig, voter.Server).version(); v != nil && v.GreaterThan(hv) {
+			downgrade = true
+		}
+		if voter.Server.RaftVersion > raftVersion {
+			raftVersion = voter.Server.RaftVersion
+		}
+	}
+	for _, srv := range targets {
+		if srv.Server.RaftVersion > 0 && srv.Server.RaftVersion < raftVersion {
+			return downgrade, true
+		}
+	}
+	return downgrade, false
+}
+
+// performZoneUpgrade upgrades the voters to the target version hv zone by zone. A zone with voters in
+// both versions has its old voters above the zone target demoted (or the leadership transferred if the
+// leader is one of them), otherwise a standby in the target version is promoted in the first zone that
+// has one, so the voters of a zone never drop below its target.
+func (p *ImprovedPromoter) performZoneUpgrade(config *ra.Config, extraConfig ExtraConfig, state *ra.State, filtered map[raft.ServerID]*ra.ServerState, hv *version.Version, upgrade UpgradeState) (UpgradeState, ra.RaftChanges) {
+	var changes ra.RaftChanges
+	now := p.now()
+	minStableDuration := state.ServerStabilizationTime(config)
+
+	zones := make(map[string]*zoneUpgrade)
+	zone := func(name string) *zoneUpgrade {
+		if _, ok := zones[name]; !ok {
+			zones[name] = &zoneUpgrade{}
+		}
+		return zones[name]
+	}
+	for _, id := range state.Voters {
+		srv, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		info := p.serverInfo(extraConfig, srv.Server)
+		v := info.version()
+		switch {
+		case v == nil:
+			continue
+		case v.Equal(hv):
+			// only healthy and stable voters replace the old ones of their zone
+			if srv.Health.Healthy && srv.Health.IsStable(now, minStableDuration) {
+				zone(info.Zone).newVoters = append(zone(info.Zone).newVoters, id)
+			}
+		default:
+			zone(info.Zone).oldVoters = append(zone(info.Zone).oldVoters, id)
+		}
+	}
+	for _, id := range p.rankedServers(filtered, state) {
+		info := p.serverInfo(extraConfig, filtered[id].Server)
+		if v := info.version(); v != nil && v.Equal(hv) && p.upgradeReady(extraConfig, state, filtered[id]) {
+			zone(info.Zone).candidates = append(zone(info.Zone).candidates, id)
+		}
+	}
+
+	// the zone of the leader is upgraded last to avoid unneeded leadership transfers
+	leaderZone := ""
+	if leader, ok := state.Servers[state.Leader]; ok {
+		leaderZone = p.serverInfo(extraConfig, leader.Server).Zone
+	}
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == leaderZone) != (names[j] == leaderZone) {
+			return names[j] == leaderZone
+		}
+		return names[i] < names[j]
+	})
+
+	// finish the zones that already have a voter in the target version. Only the old voters above
+	// the zone target are demoted, so a zone that isn't above it gets its next standby first.
+	for _, name := range names {
+		z := zones[name]
+		if len(z.oldVoters) == 0 || len(z.newVoters) == 0 {
+			continue
+		}
+		excess := len(z.oldVoters) + len(z.newVoters) - p.zoneVoters(extraConfig, name)
+		if excess <= 0 {
+			if len(z.candidates) == 0 {
+				continue
+			}
+			changes.Promotions = append(changes.Promotions, z.candidates[0])
+			upgrade.Phase = UpgradePromoting
+			p.logger.Debug("Zone upgrade, promoting standby", "zone", name, "promotions", changes.Promotions)
+			return upgrade, changes
+		}
+
+		// the least preferred old voters are demoted, the leader only if all of them are
+		demotions := z.oldVoters
+		ra.SortServers(demotions, state)
+		sort.SliceStable(demotions, func(i, j int) bool {
+			return demotions[i] == state.Leader
+		})
+		if excess < len(demotions) {
+			demotions = demotions[len(demotions)-excess:]
+		}
+		for _, id := range demotions {
+			if id == state.Leader {
+				// transfer the leadership before demoting it
+				var newVoters []raft.ServerID
+				for _, name := range names {
+					newVoters = append(newVoters, zones[name].newVoters...)
+				}
+				upgrade.Phase = UpgradeLeaderTransfer
+				if leader, ok := p.leaderTransferTarget(extraConfig, state, p.readyServers(extraConfig, state, newVoters)); ok {
+					changes.Leader = leader
+					p.logger.Debug("Zone upgrade, transferring leadership", "zone", name, "leader", changes.Leader)
+				} else {
+					upgrade.LeaderTransferBlocked = true
+				}
+				return upgrade, changes
+			}
+		}
+		changes.Demotions = append(changes.Demotions, demotions...)
+		upgrade.Phase = UpgradeDemoting
+		p.logger.Debug("Zone upgrade, demoting old voters", "zone", name, "demotions", changes.Demotions)
+		return upgrade, changes
+	}
+
+	// promote a standby in the target version in the next zone
+	for _, name := range names {
+		z := zones[name]
+		if len(z.oldVoters) == 0 || len(z.candidates) == 0 {
+			continue
+		}
+		changes.Promotions = append(changes.Promotions, z.candidates[0])
+		upgrade.Phase = UpgradePromoting
+		p.logger.Debug("Zone upgrade, promoting standby", "zone", name, "promotions", changes.Promotions)
+		return upgrade, changes
+	}
+
+	// every zone with old voters needs a standby in the target version
+	upgrade.Phase = UpgradeWaiting
+	for _, z := range zones {
+		if len(z.oldVoters) > 0 {
+			upgrade.NewServersNeeded++
+		}
+	}
+	p.logger.Debug("Zone upgrade, waiting for standbys in the target version", "target", hv, "needed", upgrade.NewServersNeeded)
+	return upgrade, changes
+}
+
+// upgradeReady returns if the server is caught up with the leader according to the readiness gates
+// ExtraConfig.UpgradeMaxTrailingLogs and ExtraConfig.UpgradeMaxLastContact
+func (p *ImprovedPromoter) upgradeReady(extraConfig ExtraConfig, state *ra.State, srv *ra.ServerState) bool {
+	if srv.Server.ID == state.Leader {
+		return true
+	}
+	if maxLastContact := extraConfig.UpgradeMaxLastContact; maxLastContact > 0 && srv.Stats.LastContact > maxLastContact {
+		p.logger.Debug("Server not ready, last contact too old", "id", srv.Server.ID, "lastcontact", srv.Stats.LastContact, "max", maxLastContact)
+		return false
+	}
+	if maxTrailing := extraConfig.UpgradeMaxTrailingLogs; maxTrailing > 0 {
+		leader, ok := state.Servers[state.Leader]
+		if !ok {
+			return false
+		}
+		if leaderIndex := leader.Stats.LastIndex; srv.Stats.LastIndex+maxTrailing < leaderIndex {
+			p.logger.Debug("Server not ready, too many trailing logs", "id", srv.Server.ID, "lastindex", srv.Stats.LastIndex, "leaderindex", leaderIndex, "max", maxTrailing)
+			return false
+		}
+	}
+	return true
+}
+
+// readyServers returns the given servers that pass the readiness gates
+func (p *ImprovedPromoter) readyServers(extraConfig ExtraConfig, state *ra.State, ids []raft.ServerID) []raft.ServerID {
+	ready := make([]raft.ServerID, 0, len(ids))
+	for _, id := range ids {
+		if srv, ok := state.Servers[id]; ok && p.upgradeReady(extraConfig, state, srv) {
+			ready = append(ready, id)
+		}
+	}
+	return ready
+}
+
+// versionVoters returns the voters in the target version and the ones in other (valid) versions
+func (p *ImprovedPromoter) versionVoters(extraConfig ExtraConfig, state *ra.State, target *version.Version) ([]raft.ServerID, []raft.ServerID) {
+	newVoters := make([]raft.ServerID, 0)
+	oldVoters := make([]raft.ServerID, 0)
+	for _, id := range state.Voters {
+		srv, ok := state.Servers[id]
+		if !ok {
+			continue
+		}
+		v := p.serverInfo(extraConfig, srv.Server).version()
+		switch {
+		case v == nil:
+			continue
+		case v.Equal(target):
+			newVoters = append(newVoters, id)
+		default:
+			oldVoters = append(oldVoters, id)
+		}
+	}
+	return newVoters, oldVoters
+}
@@ -0,0 +1,759 @@
+package autopilot
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	ra "github.com/hashicorp/raft-autopilot"
+)
+
+func TestZoneUpgrade(t *testing.T) {
+	unstable := func(srv *ra.ServerState) *ra.ServerState {
+		srv.Health.StableSince = time.Now()
+		return srv
+	}
+	config := testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", UpgradeMode: UpgradeModeZone})
+	perZone := testConfig(ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", UpgradeMode: UpgradeModeZone, VotersPerZone: 2})
+	m := func(zone, version string) map[string]string {
+		return map[string]string{"zone": zone, "version": version}
+	}
+
+	cases := []struct {
+		name       string
+		config     *ra.Config
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+		leader     raft.ServerID
+	}{
+		{
+			name: "no standbys in the target version",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "1.0.0")),
+				testServer("x", ra.RaftNonVoter, m("4", "2.0.0")),
+			},
+		},
+		{
+			name: "first zone, promote standby",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftNonVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftNonVoter, m("3", "2.0.0")),
+			},
+			promotions: []raft.ServerID{"e"},
+		},
+		{
+			name: "first zone, demote old voter",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftNonVoter, m("3", "2.0.0")),
+			},
+			demotions: []raft.ServerID{"b"},
+		},
+		{
+			name: "second zone, promote standby",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftNonVoter, m("3", "2.0.0")),
+			},
+			promotions: []raft.ServerID{"f"},
+		},
+		{
+			name: "leader zone, promote standby",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftVoter, m("3", "2.0.0")),
+			},
+			promotions: []raft.ServerID{"d"},
+		},
+		{
+			name: "leader zone, transfer leadership",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftVoter, m("3", "2.0.0")),
+			},
+			leader: "d",
+		},
+		{
+			name: "leader zone, demote old voter",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, m("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftLeader, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftVoter, m("3", "2.0.0")),
+			},
+			demotions: []raft.ServerID{"a"},
+		},
+		{
+			name: "unhealthy new voter doesn't replace the old one",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				failedServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftNonVoter, m("3", "2.0.0")),
+			},
+			promotions: []raft.ServerID{"f"},
+		},
+		{
+			name: "new voter not stable yet doesn't replace the old one",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				unstable(testServer("e", ra.RaftVoter, m("2", "2.0.0"))),
+				testServer("x", ra.RaftNonVoter, m("4", "2.0.0")),
+			},
+		},
+		{
+			name: "unhealthy new voter in the leader zone, wait",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftNonVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftNonVoter, m("3", "1.0.0")),
+				failedServer("d", ra.RaftVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("f", ra.RaftVoter, m("3", "2.0.0")),
+			},
+		},
+		{
+			name:   "two voters per zone, promote standby before demoting",
+			config: perZone,
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("a2", ra.RaftVoter, m("1", "1.0.0")),
+				testServer("b1", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("b2", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("b3", ra.RaftNonVoter, m("2", "2.0.0")),
+				testServer("c1", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("c2", ra.RaftVoter, m("3", "1.0.0")),
+			},
+			promotions: []raft.ServerID{"b3"},
+		},
+		{
+			name:   "two voters per zone, demote old voter above the target",
+			config: perZone,
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("a2", ra.RaftVoter, m("1", "1.0.0")),
+				testServer("b1", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("b2", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("b3", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("c1", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("c2", ra.RaftVoter, m("3", "1.0.0")),
+			},
+			demotions: []raft.ServerID{"b1"},
+		},
+		{
+			name:   "two voters per zone, leader kept while other old voters are demoted",
+			config: perZone,
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("a2", ra.RaftVoter, m("1", "1.0.0")),
+				testServer("a3", ra.RaftVoter, m("1", "2.0.0")),
+				testServer("b2", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("b3", ra.RaftVoter, m("2", "2.0.0")),
+			},
+			demotions: []raft.ServerID{"a2"},
+		},
+		{
+			name:   "two voters per zone, leader demoted last",
+			config: perZone,
+			servers: []*ra.ServerState{
+				testServer("a1", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("a3", ra.RaftVoter, m("1", "2.0.0")),
+				testServer("a4", ra.RaftVoter, m("1", "2.0.0")),
+				testServer("b2", ra.RaftVoter, m("2", "2.0.0")),
+				testServer("b3", ra.RaftVoter, m("2", "2.0.0")),
+			},
+			leader: "a3",
+		},
+		{
+			name:   "without zones the bulk mode is used",
+			config: testConfig(ExtraConfig{UpgradeVersionTag: "version", UpgradeMode: UpgradeModeZone}),
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, m("1", "1.0.0")),
+				testServer("b", ra.RaftVoter, m("2", "1.0.0")),
+				testServer("c", ra.RaftVoter, m("3", "1.0.0")),
+				testServer("d", ra.RaftNonVoter, m("1", "2.0.0")),
+				testServer("e", ra.RaftNonVoter, m("2", "2.0.0")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		c := config
+		if tc.config != nil {
+			c = tc.config
+		}
+		p := testPromoter()
+		changes := p.CalculatePromotionsAndDemotions(c, testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, tc.leader)
+	}
+}
+
+func TestUpgradeState(t *testing.T) {
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+
+	cases := []struct {
+		name     string
+		servers  []*ra.ServerState
+		expected UpgradeState
+	}{
+		{
+			name: "no upgrade",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.0.0")),
+				testServer("c", ra.RaftVoter, v("1.0.0")),
+			},
+			expected: UpgradeState{Phase: UpgradeNone},
+		},
+		{
+			name: "waiting",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.1.0")),
+				testServer("c", ra.RaftVoter, v("1.0.0")),
+				testServer("d", ra.RaftNonVoter, v("2.0.0")),
+			},
+			expected: UpgradeState{
+				Phase:            UpgradeWaiting,
+				TargetVersion:    "2.0.0",
+				OldVersions:      []string{"1.0.0", "1.1.0"},
+				OldVoters:        []raft.ServerID{"a", "b", "c"},
+				NewServersNeeded: 2,
+			},
+		},
+		{
+			name: "promoting",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.0.0")),
+				testServer("c", ra.RaftVoter, v("1.0.0")),
+				testServer("d", ra.RaftNonVoter, v("2.0.0")),
+				testServer("e", ra.RaftNonVoter, v("2.0.0")),
+				testServer("f", ra.RaftNonVoter, v("2.0.0")),
+			},
+			expected: UpgradeState{
+				Phase:         UpgradePromoting,
+				TargetVersion: "2.0.0",
+				OldVersions:   []string{"1.0.0"},
+				OldVoters:     []raft.ServerID{"a", "b", "c"},
+			},
+		},
+		{
+			name: "leader transfer",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.0.0")),
+				testServer("c", ra.RaftVoter, v("2.0.0")),
+			},
+			expected: UpgradeState{
+				Phase:         UpgradeLeaderTransfer,
+				TargetVersion: "2.0.0",
+				OldVersions:   []string{"1.0.0"},
+				OldVoters:     []raft.ServerID{"a", "b"},
+			},
+		},
+		{
+			name: "demoting",
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, v("1.0.0")),
+				testServer("b", ra.RaftVoter, v("1.0.0")),
+				testServer("c", ra.RaftLeader, v("2.0.0")),
+			},
+			expected: UpgradeState{
+				Phase:         UpgradeDemoting,
+				TargetVersion: "2.0.0",
+				OldVersions:   []string{"1.0.0"},
+				OldVoters:     []raft.ServerID{"a", "b"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		info := testPromoter().GetStateExt(config, testState(tc.servers...)).(ExtraStateInfo)
+		if !reflect.DeepEqual(info.Upgrade, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.expected, info.Upgrade)
+		}
+	}
+}
+
+func TestUpgradePhaseChanges(t *testing.T) {
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version"})
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Info})))
+
+	rounds := [][]*ra.ServerState{
+		{testServer("a", ra.RaftLeader, v("1.0.0")), testServer("b", ra.RaftNonVoter, v("2.0.0"))},
+		{testServer("a", ra.RaftLeader, v("1.0.0")), testServer("b", ra.RaftNonVoter, v("2.0.0"))},
+		{testServer("a", ra.RaftLeader, v("1.0.0")), testServer("b", ra.RaftVoter, v("2.0.0"))},
+		{testServer("a", ra.RaftVoter, v("1.0.0")), testServer("b", ra.RaftLeader, v("2.0.0"))},
+		{testServer("a", ra.RaftNonVoter, v("1.0.0")), testServer("b", ra.RaftLeader, v("2.0.0"))},
+	}
+	for _, servers := range rounds {
+		p.CalculatePromotionsAndDemotions(config, testState(servers...))
+	}
+
+	// promoting, leader-transfer, demoting and none (old non voter left)
+	if n := strings.Count(buf.String(), "Upgrade migration phase changed"); n != 4 {
+		t.Errorf("expected 4 phase changes, got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestUpgradeControls(t *testing.T) {
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+	servers := []*ra.ServerState{
+		testServer("a", ra.RaftLeader, v("1.0.0")),
+		testServer("b", ra.RaftVoter, v("1.0.0")),
+		testServer("c", ra.RaftVoter, v("1.0.0")),
+		testServer("d", ra.RaftNonVoter, v("1.1.0")),
+		testServer("e", ra.RaftNonVoter, v("1.1.0")),
+		testServer("f", ra.RaftNonVoter, v("1.1.0")),
+		testServer("g", ra.RaftNonVoter, v("2.0.0")),
+		testServer("h", ra.RaftNonVoter, v("2.0.0")),
+		testServer("i", ra.RaftNonVoter, v("2.0.0")),
+	}
+
+	cases := []struct {
+		name       string
+		extra      ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		phase      UpgradePhase
+		target     string
+		paused     bool
+	}{
+		{
+			name:       "higher version",
+			extra:      ExtraConfig{UpgradeVersionTag: "version"},
+			servers:    servers,
+			promotions: []raft.ServerID{"g", "h", "i"},
+			phase:      UpgradePromoting,
+			target:     "2.0.0",
+		},
+		{
+			name:    "paused",
+			extra:   ExtraConfig{UpgradeVersionTag: "version", PauseUpgradeMigration: true},
+			servers: servers,
+			phase:   UpgradePromoting,
+			target:  "2.0.0",
+			paused:  true,
+		},
+		{
+			name:       "pinned target",
+			extra:      ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: "v1.1"},
+			servers:    servers,
+			promotions: []raft.ServerID{"d", "e", "f"},
+			phase:      UpgradePromoting,
+			target:     "1.1.0",
+		},
+		{
+			name:       "invalid pinned target",
+			extra:      ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: "1.x"},
+			servers:    servers,
+			promotions: []raft.ServerID{"g", "h", "i"},
+			phase:      UpgradePromoting,
+			target:     "2.0.0",
+		},
+		{
+			name:    "pinned target without servers",
+			extra:   ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: "3.0.0"},
+			servers: servers,
+			phase:   UpgradeWaiting,
+			target:  "3.0.0",
+		},
+		{
+			name:  "pinned target reached",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: "1.0.0"},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("1.0.0")),
+				testServer("b", ra.RaftNonVoter, v("1.0.0")),
+			},
+			promotions: []raft.ServerID{"b"},
+			phase:      UpgradeNone,
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter()
+		config := testConfig(tc.extra)
+		state := testState(tc.servers...)
+		changes := p.CalculatePromotionsAndDemotions(config, state)
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, "")
+
+		upgrade := p.GetStateExt(config, state).(ExtraStateInfo).Upgrade
+		if upgrade.Phase != tc.phase || upgrade.TargetVersion != tc.target || upgrade.Paused != tc.paused {
+			t.Errorf("%s: expected phase %q, target %q and paused %v, got %#v", tc.name, tc.phase, tc.target, tc.paused, upgrade)
+		}
+	}
+}
+
+func TestInvalidTargetWarning(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	state := testState(
+		testServer("a", ra.RaftLeader, map[string]string{"version": "1.0.0"}),
+		testServer("b", ra.RaftNonVoter, map[string]string{"version": "2.0.0"}),
+	)
+	failed := &ra.FailedServers{}
+
+	// the warning is only logged when the invalid target changes, whatever the promoter methods called
+	rounds := []struct {
+		target   string
+		warnings int
+	}{
+		{target: "1.x", warnings: 1},
+		{target: "1.x", warnings: 0},
+		{target: "2.x", warnings: 1},
+		{target: "2.0.0", warnings: 0},
+		{target: "2.x", warnings: 1},
+	}
+	for i, r := range rounds {
+		buf.Reset()
+		config := testConfig(ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: r.target})
+		p.GetStateExt(config, state)
+		p.GetNodeTypes(config, state)
+		p.CalculatePromotionsAndDemotions(config, state)
+		p.FilterFailedServerRemovals(config, state, failed)
+		if n := strings.Count(buf.String(), "Invalid upgrade target version"); n != r.warnings {
+			t.Errorf("round %d: expected %d warnings, got %d:\n%s", i, r.warnings, n, buf.String())
+		}
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	v := func(version string) map[string]string {
+		return map[string]string{"version": version}
+	}
+	raftVersion := func(srv *ra.ServerState, version int) *ra.ServerState {
+		srv.Server.RaftVersion = version
+		return srv
+	}
+
+	cases := []struct {
+		name       string
+		extra      ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		demotions  []raft.ServerID
+		leader     raft.ServerID
+		warnings   []string
+	}{
+		{
+			name:  "direction down, promote old servers",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeDirection: UpgradeDirectionDown},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("2.0.0")),
+				testServer("b", ra.RaftVoter, v("2.0.0")),
+				testServer("c", ra.RaftVoter, v("2.0.0")),
+				testServer("d", ra.RaftNonVoter, v("1.0.0")),
+				testServer("e", ra.RaftNonVoter, v("1.0.0")),
+				testServer("f", ra.RaftNonVoter, v("1.0.0")),
+			},
+			promotions: []raft.ServerID{"d", "e", "f"},
+			warnings:   []string{"Upgrade migration to a lower version"},
+		},
+		{
+			name:  "direction down, transfer leadership",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeDirection: UpgradeDirectionDown},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("2.0.0")),
+				testServer("b", ra.RaftVoter, v("2.0.0")),
+				testServer("c", ra.RaftVoter, v("1.0.0")),
+			},
+			leader:   "c",
+			warnings: []string{"Upgrade migration to a lower version"},
+		},
+		{
+			name:  "direction down, demote new voters",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeDirection: UpgradeDirectionDown},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftVoter, v("2.0.0")),
+				testServer("b", ra.RaftVoter, v("2.0.0")),
+				testServer("c", ra.RaftLeader, v("1.0.0")),
+			},
+			demotions: []raft.ServerID{"a", "b"},
+			warnings:  []string{"Upgrade migration to a lower version"},
+		},
+		{
+			name:  "pinned lower target",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeTargetVersion: "1.1.0"},
+			servers: []*ra.ServerState{
+				testServer("a", ra.RaftLeader, v("2.0.0")),
+				testServer("b", ra.RaftNonVoter, v("1.0.0")),
+				testServer("c", ra.RaftNonVoter, v("1.1.0")),
+			},
+			promotions: []raft.ServerID{"c"},
+			warnings:   []string{"Upgrade migration to a lower version"},
+		},
+		{
+			name:  "lower raft version",
+			extra: ExtraConfig{UpgradeVersionTag: "version", UpgradeDirection: UpgradeDirectionDown},
+			servers: []*ra.ServerState{
+				raftVersion(testServer("a", ra.RaftLeader, v("2.0.0")), 3),
+				raftVersion(testServer("b", ra.RaftNonVoter, v("1.0.0")), 2),
+			},
+			promotions: []raft.ServerID{"b"},
+			warnings:   []string{"Upgrade migration to a lower version", "raft compatibility might be at risk"},
+		},
+		{
+			name:  "direction up",
+			extra: ExtraConfig{UpgradeVersionTag: "version"},
+			servers: []*ra.ServerState{
+				raftVersion(testServer("a", ra.RaftLeader, v("1.0.0")), 2),
+				raftVersion(testServer("b", ra.RaftNonVoter, v("2.0.0")), 3),
+				raftVersion(testServer("c", ra.RaftNonVoter, v("0.9.0")), 1),
+			},
+			promotions: []raft.ServerID{"b"},
+		},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+		config := testConfig(tc.extra)
+		state := testState(tc.servers...)
+		for i := 0; i < 2; i++ {
+			changes := p.CalculatePromotionsAndDemotions(config, state)
+			verifyChanges(t, tc.name, changes, tc.promotions, tc.demotions, tc.leader)
+		}
+
+		// the warnings are logged once, when the migration starts
+		if n := strings.Count(buf.String(), "[WARN]"); n != len(tc.warnings) {
+			t.Errorf("%s: expected %d warnings, got %d:\n%s", tc.name, len(tc.warnings), n, buf.String())
+		}
+		for _, warning := range tc.warnings {
+			if !strings.Contains(buf.String(), warning) {
+				t.Errorf("%s: expected warning %q, got:\n%s", tc.name, warning, buf.String())
+			}
+		}
+	}
+}
+
+func TestUpgradeReadiness(t *testing.T) {
+	m := func(zone, version string) map[string]string {
+		return map[string]string{"zone": zone, "version": version}
+	}
+	stats := func(srv *ra.ServerState, lastIndex uint64, lastContact time.Duration) *ra.ServerState {
+		srv.Stats = ra.ServerStats{LastIndex: lastIndex, LastContact: lastContact}
+		return srv
+	}
+	gates := ExtraConfig{UpgradeVersionTag: "version", UpgradeMaxTrailingLogs: 100, UpgradeMaxLastContact: time.Second}
+
+	cases := []struct {
+		name       string
+		extra      ExtraConfig
+		servers    []*ra.ServerState
+		promotions []raft.ServerID
+		leader     raft.ServerID
+	}{
+		{
+			name:  "trailing server is not useful",
+			extra: gates,
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "1.0.0")), 1000, 0),
+				stats(testServer("c", ra.RaftNonVoter, m("1", "2.0.0")), 950, 0),
+				stats(testServer("d", ra.RaftNonVoter, m("2", "2.0.0")), 500, 0),
+			},
+		},
+		{
+			name:  "servers without contact are not useful",
+			extra: gates,
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "1.0.0")), 1000, 0),
+				stats(testServer("c", ra.RaftNonVoter, m("1", "2.0.0")), 1000, 0),
+				stats(testServer("d", ra.RaftNonVoter, m("2", "2.0.0")), 1000, 2*time.Second),
+			},
+		},
+		{
+			name:  "servers caught up",
+			extra: gates,
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "1.0.0")), 1000, 0),
+				stats(testServer("c", ra.RaftNonVoter, m("1", "2.0.0")), 950, 500*time.Millisecond),
+				stats(testServer("d", ra.RaftNonVoter, m("2", "2.0.0")), 1000, 0),
+			},
+			promotions: []raft.ServerID{"c", "d"},
+		},
+		{
+			name:  "gates disabled",
+			extra: ExtraConfig{UpgradeVersionTag: "version"},
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "1.0.0")), 1000, 0),
+				stats(testServer("c", ra.RaftNonVoter, m("1", "2.0.0")), 0, time.Minute),
+				stats(testServer("d", ra.RaftNonVoter, m("2", "2.0.0")), 0, time.Minute),
+			},
+			promotions: []raft.ServerID{"c", "d"},
+		},
+		{
+			name:  "leadership to a caught up voter",
+			extra: gates,
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "2.0.0")), 10, 0),
+				stats(testServer("c", ra.RaftVoter, m("3", "2.0.0")), 1000, 0),
+			},
+			leader: "c",
+		},
+		{
+			name:  "no voter ready for the leadership",
+			extra: gates,
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "2.0.0")), 10, 0),
+				stats(testServer("c", ra.RaftVoter, m("3", "2.0.0")), 1000, 5*time.Second),
+			},
+		},
+		{
+			name:  "zone upgrade skips trailing standby",
+			extra: ExtraConfig{RedundancyZoneTag: "zone", UpgradeVersionTag: "version", UpgradeMode: UpgradeModeZone, UpgradeMaxTrailingLogs: 100},
+			servers: []*ra.ServerState{
+				stats(testServer("a", ra.RaftLeader, m("1", "1.0.0")), 1000, 0),
+				stats(testServer("b", ra.RaftVoter, m("2", "1.0.0")), 1000, 0),
+				stats(testServer("c", ra.RaftVoter, m("3", "1.0.0")), 1000, 0),
+				stats(testServer("e", ra.RaftNonVoter, m("2", "2.0.0")), 10, 0),
+				stats(testServer("f", ra.RaftNonVoter, m("3", "2.0.0")), 1000, 0),
+			},
+			promotions: []raft.ServerID{"f"},
+		},
+	}
+	for _, tc := range cases {
+		p := testPromoter()
+		changes := p.CalculatePromotionsAndDemotions(testConfig(tc.extra), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, tc.promotions, nil, tc.leader)
+	}
+}
+
+func TestLeaderTransferTarget(t *testing.T) {
+	m := func(zone, version, noLeader string) map[string]string {
+		return map[string]string{"zone": zone, "version": version, "no-leader": noLeader}
+	}
+	servers := []*ra.ServerState{
+		testServer("a", ra.RaftLeader, m("2", "1.0.0", "")),
+		testServer("b", ra.RaftVoter, m("1", "2.0.0", "")),
+		testServer("c", ra.RaftVoter, m("2", "2.0.0", "")),
+		testServer("d", ra.RaftVoter, m("3", "2.0.0", "")),
+	}
+	servers[1].Stats = ra.ServerStats{LastIndex: 90, LastContact: 30 * time.Millisecond}
+	servers[2].Stats = ra.ServerStats{LastIndex: 95, LastContact: 20 * time.Millisecond}
+	servers[3].Stats = ra.ServerStats{LastIndex: 100, LastContact: 10 * time.Millisecond}
+
+	cases := []struct {
+		name    string
+		extra   ExtraConfig
+		options []Option
+		servers []*ra.ServerState
+		leader  raft.ServerID
+	}{
+		{
+			name:    "default",
+			servers: servers,
+			leader:  "b",
+		},
+		{
+			name:    "leader zone",
+			options: []Option{WithLeaderRanker(ZoneAffinityRanker("zone"))},
+			servers: servers,
+			leader:  "c",
+		},
+		{
+			name:    "highest log index",
+			options: []Option{WithLeaderRanker(LastIndexRanker())},
+			servers: servers,
+			leader:  "d",
+		},
+		{
+			name:    "lowest latency",
+			options: []Option{WithLeaderRanker(LastContactRanker())},
+			servers: servers,
+			leader:  "d",
+		},
+		{
+			name:  "no leader tag",
+			extra: ExtraConfig{NoLeaderTag: "no-leader"},
+			servers: []*ra.ServerState{
+				servers[0],
+				testServer("b", ra.RaftVoter, m("1", "2.0.0", "true")),
+				servers[2],
+				servers[3],
+			},
+			leader: "c",
+		},
+		{
+			name:  "only no leader servers",
+			extra: ExtraConfig{NoLeaderTag: "no-leader"},
+			servers: []*ra.ServerState{
+				servers[0],
+				testServer("b", ra.RaftVoter, m("1", "2.0.0", "yes")),
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc.extra.UpgradeVersionTag = "version"
+		p := testPromoter(tc.options...)
+		changes := p.CalculatePromotionsAndDemotions(testConfig(tc.extra), testState(tc.servers...))
+		verifyChanges(t, tc.name, changes, nil, nil, tc.leader)
+	}
+}
+
+func TestLeaderTransferBlocked(t *testing.T) {
+	var buf bytes.Buffer
+	p := testPromoter(WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Warn})))
+	config := testConfig(ExtraConfig{UpgradeVersionTag: "version", NoLeaderTag: "no-leader"})
+	state := testState(
+		testServer("a", ra.RaftLeader, map[string]string{"version": "1.0.0"}),
+		testServer("b", ra.RaftVoter, map[string]string{"version": "2.0.0", "no-leader": "true"}),
+	)
+
+	// the migration is stuck in the leader transfer, it's warned once and reported in the state
+	for i := 0; i < 2; i++ {
+		changes := p.CalculatePromotionsAndDemotions(config, state)
+		verifyChanges(t, "blocked", changes, nil, nil, "")
+	}
+	if n := strings.Count(buf.String(), "Upgrade migration stuck"); n != 1 {
+		t.Errorf("expected 1 warning, got %d:\n%s", n, buf.String())
+	}
+	info := p.GetStateExt(config, state).(ExtraStateInfo)
+	if info.Upgrade.Phase != UpgradeLeaderTransfer || !info.Upgrade.LeaderTransferBlocked {
+		t.Errorf("expected blocked leader transfer, got %#v", info.Upgrade)
+	}
+}
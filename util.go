@@ -1,48 +1,148 @@
 package autopilot
 
 import (
-	"time"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/raft"
 	ra "github.com/hashicorp/raft-autopilot"
 )
 
-func serverZone(srv ra.Server) string {
-	extra := srv.Ext.(ExtraServerInfo)
-	return extra.Zone
+// toExtraConfig converts the autopilot config Ext into an ExtraConfig. It accepts
+// ExtraConfig, *ExtraConfig or nil, the last two resulting in the zero value.
+func toExtraConfig(ext interface{}) (ExtraConfig, error) {
+	switch v := ext.(type) {
+	case nil:
+		return ExtraConfig{}, nil
+	case ExtraConfig:
+		return v, nil
+	case *ExtraConfig:
+		if v == nil {
+			return ExtraConfig{}, nil
+		}
+		return *v, nil
+	default:
+		return ExtraConfig{}, fmt.Errorf("unexpected config ext type %T", ext)
+	}
+}
+
+// toExtraServerInfo converts the server Ext into an ExtraServerInfo. It accepts
+// ExtraServerInfo, *ExtraServerInfo or nil. A nil value is returned if there's no info.
+func toExtraServerInfo(ext interface{}) (*ExtraServerInfo, error) {
+	switch v := ext.(type) {
+	case nil:
+		return nil, nil
+	case ExtraServerInfo:
+		return &v, nil
+	case *ExtraServerInfo:
+		if v == nil {
+			return nil, nil
+		}
+		info := *v
+		return &info, nil
+	default:
+		return nil, fmt.Errorf("unexpected server ext type %T", ext)
+	}
 }
 
-func getVersionInfo(config *ra.Config, state *ra.State) (map[string][]*ra.ServerState, *version.Version, *version.Version) {
+// getVersionInfo returns the stable servers grouped by version and the higher and
+// lower versions found. Servers with an invalid version are left out.
+func (p *ImprovedPromoter) getVersionInfo(config *ra.Config, extraConfig ExtraConfig, state *ra.State) (map[string][]*ra.ServerState, *version.Version, *version.Version) {
 	versions := make(map[string][]*ra.ServerState)
 	var higher, lower *version.Version
 
-	now := time.Now()
+	now := p.now()
 	minStableDuration := state.ServerStabilizationTime(config)
 	for _, srv := range state.Servers {
-		if srv.Health.IsStable(now, minStableDuration) {
-			extra := srv.Server.Ext.(ExtraServerInfo)
-			version, ok := versions[extra.Version]
-			if !ok {
-				version = make([]*ra.ServerState, 0)
-			}
-			versions[extra.Version] = append(version, srv)
-		}
-	}
-	first := true
-	for k := range versions {
-		v := version.Must(version.NewVersion(k))
-		if first {
-			higher = v
-			lower = v
-			first = false
+		if !srv.Health.IsStable(now, minStableDuration) {
 			continue
 		}
-		if v.GreaterThan(higher) {
+		extra := p.serverInfo(extraConfig, srv.Server)
+		v := extra.version()
+		if v == nil {
+			p.logger.Debug("Ignoring server with invalid version", "id", srv.Server.ID, "version", extra.Version)
+			continue
+		}
+		versions[v.String()] = append(versions[v.String()], srv)
+		if higher == nil || v.GreaterThan(higher) {
 			higher = v
 		}
-		if v.LessThan(lower) {
+		if lower == nil || v.LessThan(lower) {
 			lower = v
 		}
 	}
 	return versions, higher, lower
 }
+
+// parseBoolTag parses a boolean meta value. Besides the values accepted by strconv.ParseBool
+// it accepts yes/no, y/n and on/off in any case. An empty value is false. The second
+// value returned is false if the value couldn't be parsed.
+func parseBoolTag(value string) (bool, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return false, true
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b, true
+	}
+	switch strings.ToLower(value) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, true
+	case "0", "f", "false", "n", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// zoneFailureTolerance returns the number of zones that can be lost while keeping quorum,
+// given the number of voters and the healthy voters in each zone. The zones with more
+// voters are considered first as that's the worst case.
+func zoneFailureTolerance(voters int, healthyZoneVoters map[string]int) int {
+	counts := make([]int, 0, len(healthyZoneVoters))
+	healthy := 0
+	for _, count := range healthyZoneVoters {
+		if count > 0 {
+			counts = append(counts, count)
+			healthy += count
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+
+	quorum := voters/2 + 1
+	tolerance := 0
+	for _, count := range counts {
+		if healthy-count < quorum {
+			break
+		}
+		healthy -= count
+		tolerance++
+	}
+	return tolerance
+}
+
+// failureTolerance returns the number of voters that can fail while keeping quorum
+func failureTolerance(voters, healthy int) int {
+	if tolerance := healthy - (voters/2 + 1); tolerance > 0 {
+		return tolerance
+	}
+	return 0
+}
+
+func sortIDs(ids []raft.ServerID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// sortVersions sorts the version strings from lower to higher
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		vi, erri := version.NewVersion(versions[i])
+		vj, errj := version.NewVersion(versions[j])
+		if erri != nil || errj != nil {
+			return versions[i] < versions[j]
+		}
+		return vi.LessThan(vj)
+	})
+}
@@ -0,0 +1,59 @@
+package autopilot
+
+import "testing"
+
+func TestParseBoolTag(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected bool
+		valid    bool
+	}{
+		{value: "", expected: false, valid: true},
+		{value: "true", expected: true, valid: true},
+		{value: "TRUE", expected: true, valid: true},
+		{value: "True", expected: true, valid: true},
+		{value: "t", expected: true, valid: true},
+		{value: "1", expected: true, valid: true},
+		{value: "yes", expected: true, valid: true},
+		{value: "Y", expected: true, valid: true},
+		{value: "On", expected: true, valid: true},
+		{value: " true ", expected: true, valid: true},
+		{value: "false", expected: false, valid: true},
+		{value: "FALSE", expected: false, valid: true},
+		{value: "f", expected: false, valid: true},
+		{value: "0", expected: false, valid: true},
+		{value: "no", expected: false, valid: true},
+		{value: "N", expected: false, valid: true},
+		{value: "off", expected: false, valid: true},
+		{value: "maybe", expected: false, valid: false},
+		{value: "2", expected: false, valid: false},
+	}
+	for _, tc := range cases {
+		value, valid := parseBoolTag(tc.value)
+		if value != tc.expected || valid != tc.valid {
+			t.Errorf("%q: expected (%v, %v), got (%v, %v)", tc.value, tc.expected, tc.valid, value, valid)
+		}
+	}
+}
+
+func TestZoneFailureTolerance(t *testing.T) {
+	cases := []struct {
+		name      string
+		voters    int
+		zones     map[string]int
+		tolerance int
+	}{
+		{name: "no voters", voters: 0, zones: map[string]int{}, tolerance: 0},
+		{name: "one zone", voters: 3, zones: map[string]int{"1": 3}, tolerance: 0},
+		{name: "three zones, one voter each", voters: 3, zones: map[string]int{"1": 1, "2": 1, "3": 1}, tolerance: 1},
+		{name: "five zones, one voter each", voters: 5, zones: map[string]int{"1": 1, "2": 1, "3": 1, "4": 1, "5": 1}, tolerance: 2},
+		{name: "uneven zones", voters: 5, zones: map[string]int{"1": 3, "2": 1, "3": 1}, tolerance: 0},
+		{name: "unhealthy voter", voters: 3, zones: map[string]int{"1": 1, "2": 1}, tolerance: 0},
+		{name: "zones without voters are ignored", voters: 3, zones: map[string]int{"1": 1, "2": 1, "3": 1, "4": 0}, tolerance: 1},
+	}
+	for _, tc := range cases {
+		if tolerance := zoneFailureTolerance(tc.voters, tc.zones); tolerance != tc.tolerance {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.tolerance, tolerance)
+		}
+	}
+}